@@ -4,16 +4,21 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 	"knative.dev/client/pkg/kn/commands"
 	servinglib "knative.dev/client/pkg/serving"
 	servingv1 "knative.dev/serving/pkg/apis/serving/v1"
@@ -21,89 +26,136 @@ import (
 
 type Assigner struct{}
 
-// create the service and forward the request
-func (a *Assigner) AssignService(spec ServiceSpec, group RequestGroup) {
+// PackedRequest pairs a request with its json payload so the response can be delivered back
+type PackedRequest struct {
+	Request Request
+	Payload io.ReadCloser
+}
+
+// create the service and forward the request. Requests rejected while packing are removed from the group like in the
+// preprocess stages, a returned error is for the remaining requests. Failures after the requests were handed to the
+// service lifecycle are answered to the requests directly
+func (a *Assigner) AssignService(spec ServiceSpec, group *RequestGroup) error {
 	log.Println("Assigning service based on the ServiceSpec")
-	p := commands.KnParams{}
-	p.Initialize()
 
 	// Process each request in group to json payloads , store in array
-	var packedRequests []io.ReadCloser
+	var packedRequests []PackedRequest
+	var requests []Request
 	for _, req := range group.Requests {
-		packedRequest := a.CreatePayload(req)
+		payload, err := a.CreatePayload(req)
+		if err != nil {
+			rejectRequest(req, errorStatus(err), err) // only this request is malformed
+			continue
+		}
+		packedRequest := PackedRequest{Request: req, Payload: payload}
 		packedRequests = append(packedRequests, packedRequest)
+		requests = append(requests, req)
 		log.Printf("Packed request for token: %s", req.Token)
 	}
+	group.Requests = requests
+	if len(packedRequests) == 0 {
+		return nil
+	}
 
-	// Initialize the Knative serving client
-	client, err := p.NewServingClient("default")
-	if err != nil {
-		log.Fatalf("Error creating Knative serving client: %s", err.Error())
+	// Requests for a service still being created wait for it instead of creating it again
+	if serviceLifecycle.buffer(spec.key(), packedRequests) {
+		return nil
 	}
 
-	// List all services
-	serviceList, err := client.ListServices(context.Background())
+	// Look the service up in the cluster cache
+	service, err := clusterCache.Service(spec.Namespace, spec.Name)
 	if err != nil {
-		log.Fatalf("Error listing Knative services: %s", err.Error())
+		return err
 	}
 
-	// Check if the specified service name from spec exists
-	serviceExists := false
-	for _, svc := range serviceList.Items {
-		log.Printf("Found service: %s", svc.Name)
-		if svc.Name == spec.Name {
-			serviceExists = true
-			break
+	if service != nil {
+		if err := checkRoute(spec, service); err != nil {
+			return err
 		}
 	}
 
-	// There is a service running , just forward the payload
-	if serviceExists {
-		log.Printf("Service %s exists, updating the service", spec.Name)
-		a.CurrentService(spec, packedRequests)
-	} else {
+	switch {
+	case service != nil && isServiceReady(service):
+		// There is a service running , just forward the payload
+		log.Printf("Service %s exists, updating the service", spec.key())
+		target, err := serviceTarget(spec, service, group.Requests[0].Revision) // requests of a group share their revision
+		if err != nil {
+			return err
+		}
+		serviceLifecycle.markReady(spec.key())
+		if service.Annotations[scaledDownAnnotation] == "true" {
+			go restoreMinScale(spec) // traffic is back, keep the service warm again
+		}
+		a.CurrentService(target, packedRequests)
+	case service != nil:
+		// The service exists but is not ready (created by an earlier run or failed before), wait for it
+		log.Printf("Service %s exists but is not ready, waiting for it", spec.Name)
+		if serviceLifecycle.startCreating(spec.key(), packedRequests) {
+			go a.waitForServiceReadyAndForward(spec)
+		}
+	default:
 		// There isn't service running ,create a service and forward payload
 		log.Printf("Service %s does not exist, creating a new service", spec.Name)
-		a.CreateNewService(spec, packedRequests)
+		if serviceLifecycle.startCreating(spec.key(), packedRequests) {
+			if err := a.CreateNewService(spec); err != nil {
+				failBuffered(spec.key(), err) // answers this group and the groups buffered meanwhile
+			}
+		}
 	}
+	return nil
 }
 
 // CreatePayload creates a single json payload for a request
-func (a *Assigner) CreatePayload(req Request) io.ReadCloser {
+func (a *Assigner) CreatePayload(req Request) (io.ReadCloser, error) {
 	log.Println("Creating payload for request")
 
 	payload := map[string]interface{}{
 		"inputs":     req.Token,
 		"parameters": req.Par,
 	}
+	if req.chat != nil {
+		payload = chatPayload(req)
+	}
 
 	jsonPayload, err := json.Marshal(payload)
 	if err != nil {
-		log.Fatalf("Error packing request: %s", err.Error())
+		log.Printf("Error packing request: %s", err.Error())
+		return nil, newDispatchError(http.StatusBadRequest, "pack request", err)
 	}
 	log.Printf("Request Payload: %s", string(jsonPayload))
-	return ioutil.NopCloser(bytes.NewBuffer(jsonPayload))
+	return ioutil.NopCloser(bytes.NewBuffer(jsonPayload)), nil
 }
 
-// CreateNewService creates a new service and forwards the request
-func (a *Assigner) CreateNewService(spec ServiceSpec, requestPayloads []io.ReadCloser) {
+// CreateNewService creates a new service and forwards the requests buffered until it is ready
+func (a *Assigner) CreateNewService(spec ServiceSpec) error {
 	log.Printf("Creating new Knative service - Name: %s", spec.Name)
 	p := commands.KnParams{}
 	p.Initialize()
 
 	// Create new knative serving client
-	client, err := p.NewServingClient("default")
+	client, err := p.NewServingClient(spec.Namespace)
 	if err != nil {
-		log.Fatalf("Error creating Knative serving client: %s", err.Error())
+		return newDispatchError(http.StatusInternalServerError, "create Knative serving client", err)
 	}
 
 	//Create a service instance
 	var svcInstance = &servingv1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      spec.Name,
-			Namespace: "default",
+			Namespace: spec.Namespace,
 		},
 	}
+	// Label the services created by the Dispatcher, the idle collector only touches those, and the services of a tenant,
+	// its GPU quota counts them
+	svcInstance.Labels = map[string]string{managedByLabel: managedByValue}
+	if spec.Tenant != "" {
+		svcInstance.Labels[tenantLabel] = spec.Tenant
+	}
+	// Record the route of the service, so a route whose name collides with it is refused instead of served by it
+	svcInstance.Annotations = map[string]string{modelIDAnnotation: spec.ModelID}
+	if spec.Variant != "" {
+		svcInstance.Annotations[variantAnnotation] = spec.Variant
+	}
 
 	// Define resource requirements based on the spec
 	resourceRequirements := v1.ResourceRequirements{
@@ -125,174 +177,290 @@ func (a *Assigner) CreateNewService(spec ServiceSpec, requestPayloads []io.ReadC
 		}
 	}
 
-	// Select the image and command based on the spec.Model on Image Map
-	var selectedImage map[string]string
-	if spec.Model == "test" {
-		selectedImage = ImageMap["test"]
+	// Select the runtime of the model from the model catalog
+	entry := modelCatalog.Lookup(spec.ModelID, spec.Variant)
+	log.Printf("Choosed image %s for model %s variant %q", entry.Image, spec.ModelID, spec.Variant)
 
-	} else {
-		selectedImage = ImageMap["tgi"]
+	// Convert the catalog env and spec.Env (which takes precedence) to []v1.EnvVar
+	env := make(map[string]string)
+	for key, value := range entry.Env {
+		env[key] = value
 	}
-
-	image := selectedImage["image"]
-	command := selectedImage["command"]
-	fmt.Println("Choosed image", image)
-
-	// Convert spec.Env from a map[string]string to []v1.EnvVar
-	var envVars []v1.EnvVar
 	for key, value := range spec.Env {
+		env[key] = value
+	}
+	for _, key := range spec.SecretKeys {
+		delete(env, key) // read from the tenant's Secret below
+	}
+	// Sensitive values never enter the service spec, they are stored in a Secret generated for the service
+	plainEnv, sensitiveEnv := splitSensitiveEnv(env)
+	var envVars []v1.EnvVar
+	for key, value := range plainEnv {
 		envVars = append(envVars, v1.EnvVar{
 			Name:  key,
 			Value: value,
 		})
 	}
+	for _, key := range spec.SecretKeys {
+		envVars = append(envVars, secretEnvVar(key, spec.Secret))
+	}
+	var clientset kubernetes.Interface
+	if len(sensitiveEnv) > 0 {
+		if clientset, err = newClientset(); err != nil {
+			return err
+		}
+		if err := applyEnvSecret(context.Background(), clientset, spec.Namespace, spec.Name, sensitiveEnv); err != nil {
+			return kubernetesError(fmt.Sprintf("store env Secret of service %s", spec.Name), err)
+		}
+		for key := range sensitiveEnv {
+			envVars = append(envVars, secretEnvVar(key, envSecretName(spec.Name)))
+		}
+	}
 	log.Printf("Environment variables for service: %+v", envVars)
 
 	// Add all the resource requirements define to service instance
 	svcInstance.Spec.Template = servingv1.RevisionTemplateSpec{
 		ObjectMeta: metav1.ObjectMeta{
-			Annotations: map[string]string{
+			Annotations: scaleAnnotations(entry, map[string]string{
 				servinglib.UserImageAnnotationKey: "",
-				//	"autoscaling.knative.dev/max-scale": "1", // BUG HERE , not working // default let autoscaler at most scale to one
-			},
+			}),
 			Labels: spec.Label,
 		},
 		Spec: servingv1.RevisionSpec{
 			PodSpec: v1.PodSpec{
 				Containers: []v1.Container{{
-					Image:           image,
+					Image:           entry.Image,
 					ImagePullPolicy: v1.PullAlways,
 					Resources:       resourceRequirements,
-					VolumeMounts: []v1.VolumeMount{{
-						Name:      "disk-volume",
-						MountPath: "/data",
-					}},
-					Env: envVars,
-				}},
-				Volumes: []v1.Volume{{
-					Name: "disk-volume",
-					VolumeSource: v1.VolumeSource{
-						PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
-							ClaimName: "knative-pv-claim", // Use the PVC created in your cluster
-							ReadOnly:  false,              // Set to false if you need write access
-						},
-					},
+					VolumeMounts:    entry.VolumeMounts,
+					Env:             envVars,
+					ReadinessProbe:  entry.ReadinessProbe,
 				}},
+				Volumes: entry.Volumes,
 			},
 		},
 	}
 
-	if command != "" {
-		log.Printf("Setting command: %s", command)
-		svcInstance.Spec.Template.Spec.PodSpec.Containers[0].Command = []string{command}
+	container := &svcInstance.Spec.Template.Spec.PodSpec.Containers[0]
+	if len(entry.Command) > 0 {
+		log.Printf("Setting command: %v", entry.Command)
+		container.Command = entry.Command
+	}
+	if len(entry.Args) > 0 {
+		log.Printf("Setting args: %v", entry.Args)
+		container.Args = entry.Args
+	}
+	if entry.Port > 0 {
+		container.Ports = []v1.ContainerPort{{ContainerPort: entry.Port}}
 	}
 
 	// Use the service instance to create service
 	ctx := context.Background()
 	err = client.CreateService(ctx, svcInstance)
-	if err != nil {
-		log.Fatalf("Error creating Knative service: %s", err.Error())
+	if apierrors.IsAlreadyExists(err) {
+		// created by a concurrent group or another dispatcher since services were listed
+		log.Printf("Service %s already exists, waiting for it", spec.Name)
+		serviceCreations.WithLabelValues(modelLabel(spec.ModelID, spec.Model), "exists").Inc()
+		if clientset != nil {
+			if service, err := client.GetService(ctx, spec.Name); err == nil {
+				ownEnvSecret(ctx, clientset, service) // the Secret may have been created by this attempt
+			}
+		}
+	} else if err != nil {
+		log.Printf("Error creating Knative service: %s", err.Error())
+		serviceCreations.WithLabelValues(modelLabel(spec.ModelID, spec.Model), "failed").Inc()
+		return kubernetesError(fmt.Sprintf("create service %s", spec.Name), err)
+	} else {
+		log.Printf("Creating Prometheus support for service: %s", spec.Name)
+		serviceCreations.WithLabelValues(modelLabel(spec.ModelID, spec.Model), "created").Inc()
+		if clientset != nil {
+			if service, err := client.GetService(ctx, spec.Name); err == nil {
+				ownEnvSecret(ctx, clientset, service)
+			}
+		}
+		if err := checkCreatedWithinQuota(ctx, client, spec); err != nil {
+			return err
+		}
 	}
 
-	log.Printf("Creating Prometheus support for service: %s", spec.Name)
-
-	// wait for service be ready and forward payload
-	go a.waitForServiceReadyAndForward(spec, requestPayloads)
+	// wait for service be ready and forward the buffered payloads, later groups of this model are buffered meanwhile
+	go a.waitForServiceReadyAndForward(spec)
+	return nil
 }
 
 // forwards the requests to existing service
-func (a *Assigner) CurrentService(spec ServiceSpec, requestPayloads []io.ReadCloser) {
+func (a *Assigner) CurrentService(target ServiceTarget, packedRequests []PackedRequest) {
 	// Forward each request one by one
-	for _, requestPayload := range requestPayloads {
-		go a.forwardRequest(spec.Name, requestPayload)
+	for _, packedRequest := range packedRequests {
+		go a.forwardRequest(target, packedRequest)
 	}
 }
 
-// wait for service be ready and forward payload
-func (a *Assigner) waitForServiceReadyAndForward(spec ServiceSpec, requestPayloads []io.ReadCloser) {
+// wait for service be ready and forward the buffered payloads, failing them after the ready timeout
+func (a *Assigner) waitForServiceReadyAndForward(spec ServiceSpec) {
 	log.Printf("Waiting for service to be ready - Name: %s", spec.Name)
+	started := time.Now()
 	timeCounter := 0
+	readyTimeout := dispatcherConfig.Services.ReadyTimeout.Duration
+	deadline := time.Now().Add(readyTimeout)
 
-	p := commands.KnParams{}
-	p.Initialize()
-	knClient, err := p.NewServingClient("default")
-	if err != nil {
-		log.Fatalf("Error creating Knative serving client: %s", err.Error())
-	}
-
-	ctx := context.Background()
-	for {
-		service, err := knClient.GetService(ctx, spec.Name)
+	for time.Now().Before(deadline) {
+		progress := "not created yet"
+		service, err := clusterCache.Service(spec.Namespace, spec.Name)
 		if err != nil {
-			log.Fatalf("Error getting Knative service: %s", err.Error())
-		}
-
-		// wait for service to be ready
-		for _, condition := range service.Status.Conditions {
-			if condition.Type == "Ready" && condition.Status == "True" {
-				log.Printf("\nKnative Service is ready - Name: %s", spec.Name)
-				// Forward each request payload of the request group one by one
-				for _, requestPayload := range requestPayloads {
-					a.forwardRequest(spec.Name, requestPayload)
+			// the cache may not be synced yet, keep polling until the deadline
+			log.Printf("Error getting Knative service %s: %s", spec.Name, err.Error())
+		} else if service != nil && isServiceReady(service) {
+			log.Printf("\nKnative Service is ready - Name: %s", spec.key())
+			timeToReady.WithLabelValues(modelLabel(spec.ModelID, spec.Model)).Observe(time.Since(started).Seconds())
+			// Forward each request payload buffered during the cold start one by one, to the revision it asked for
+			for _, packedRequest := range serviceLifecycle.markReady(spec.key()) {
+				if packedRequest.Request.context().Err() != nil {
+					log.Printf("Dropping buffered request %s, client went away", packedRequest.Request.ID)
+					continue
+				}
+				target, err := serviceTarget(spec, service, packedRequest.Request.Revision)
+				if err != nil {
+					rejectRequest(packedRequest.Request, errorStatus(err), err)
+					continue
 				}
-				return
+				go a.forwardRequest(target, packedRequest)
 			}
+			return
+		} else if service != nil {
+			progress = revisionProgress(service)
 		}
 
-		log.Printf("Waiting service %s to be ready ... (%d seconds waited)", spec.Name, timeCounter)
+		log.Printf("Waiting service %s to be ready ... (%d seconds waited, %s)", spec.Name, timeCounter, progress)
 		timeCounter += 1
 		time.Sleep(1 * time.Second)
 	}
+
+	failBuffered(spec.key(), newDispatchError(http.StatusGatewayTimeout, fmt.Sprintf("wait for service %s", spec.Name), fmt.Errorf("not ready after %s", readyTimeout)))
+}
+
+// isServiceReady reports whether the Ready condition of a service is True
+func isServiceReady(service *servingv1.Service) bool {
+	for _, condition := range service.Status.Conditions {
+		if condition.Type == "Ready" && condition.Status == "True" {
+			return true
+		}
+	}
+	return false
 }
 
-// forward a request to the service using kourier-internal with Host header and print request info
-func (a *Assigner) forwardRequest(Name string, requestPayload io.ReadCloser) {
+// failBuffered marks a service failed and answers the requests buffered during its creation
+func failBuffered(name string, err error) {
+	buffered := serviceLifecycle.markFailed(name)
+	log.Printf("Failing %d buffered requests of service %s: %v", len(buffered), name, err)
+	for _, packedRequest := range buffered {
+		packedRequest.Request.respond(Response{StatusCode: errorStatus(err), Err: err})
+	}
+}
+
+// forward a request to the service through the ingress gateway (or its address) and deliver the response back to the client
+func (a *Assigner) forwardRequest(target ServiceTarget, packedRequest PackedRequest) {
+	Name := target.key()
 	log.Printf("Forwarding request to service: %s", Name)
+	serviceLifecycle.touch(Name)
+	request := packedRequest.Request
 
-	payload, err := ioutil.ReadAll(requestPayload)
+	payload, err := ioutil.ReadAll(packedRequest.Payload)
 	if err != nil {
 		log.Printf("Error reading request payload: %s", err.Error())
+		request.respond(Response{Err: fmt.Errorf("error reading request payload: %w", err)})
 		return
 	}
 
-	// Set the Host header to Name.default.127.0.0.1.nip.io
-	host := fmt.Sprintf("%s.default.127.0.0.1.nip.io", Name)
-	url := "http://kourier-internal.kourier-system.svc.cluster.local"
-
-	// Create the HTTP POST request
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
-	if err != nil {
-		log.Printf("Failed to create request: %v\n", err)
+	// Wait for a free slot of the service, TGI batches the requests in flight continuously
+	policy := dispatcherConfig.forwardPolicy(request.modelID())
+	limiter := limiterFor(target.route())
+	if err := limiter.acquire(request.context(), request.Priority, policy.MaxInFlight); err != nil {
+		request.respond(Response{Err: fmt.Errorf("client went away waiting for service %s: %w", Name, err)})
+		return
+	}
+	streaming := false
+	defer func() {
+		if !streaming { // a stream holds its slot until the handler closes it
+			limiter.release(policy.MaxInFlight)
+		}
+	}()
+
+	// Fail fast while the service keeps failing, instead of piling requests on it
+	breaker := breakerFor(target.route())
+	if allowed, retryAfter := breaker.allow(); !allowed {
+		circuitRejections.WithLabelValues(target.route()).Inc()
+		header := http.Header{}
+		header.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		request.respond(Response{StatusCode: http.StatusServiceUnavailable, Header: header, Err: fmt.Errorf("service %s is failing, circuit is open", Name)})
 		return
 	}
 
-	// Set headers
-	req.Host = host
-	req.Header.Set("Content-Type", "application/json")
+	// Set the Host header from the ingress host template, ex. Name.default.127.0.0.1.nip.io
+	host := target.Host
+	url := target.URL
+	switch {
+	case request.chat != nil:
+		url += "/v1/chat/completions" // applies the model's chat template, streaming or not
+	case request.Stream:
+		url += "/generate_stream" // TGI endpoint emitting one server-sent event per token
+	}
 
 	// Print out the information (Host, URL, Headers, and Payload)
 	log.Printf("Request Information:")
 	log.Printf("URL: %s", url)
 	log.Printf("Host: %s", host)
-	log.Printf("Content-Type: %s", req.Header.Get("Content-Type"))
+	log.Printf("Timeout: %s, Retries: %d", policy.Timeout.Duration, policy.Retries)
 	log.Printf("Payload: %s", string(payload))
 
-	// Send the request
-	resp, err := client.Do(req)
+	// Send the request, cancelled together with the client request
+	resp, cancel, err := sendWithRetries(request, url, host, payload, policy)
 	if err != nil {
 		log.Printf("Failed to forward request: %v\n", err)
+		if request.context().Err() != nil {
+			breaker.release()
+			request.respond(Response{Err: fmt.Errorf("failed to forward request to service %s: %w", Name, err)})
+			return
+		}
+		breaker.record(true)
+		statusCode := http.StatusBadGateway
+		if errors.Is(err, errForwardTimeout) {
+			statusCode = http.StatusGatewayTimeout
+		}
+		forwardErrors.WithLabelValues(request.metricModel(), strconv.Itoa(statusCode)).Inc()
+		request.respond(Response{StatusCode: statusCode, Err: fmt.Errorf("failed to forward request to service %s: %w", Name, err)})
 		return
 	}
-	defer resp.Body.Close()
+	breaker.record(resp.StatusCode >= http.StatusInternalServerError)
+	if resp.StatusCode >= http.StatusBadRequest {
+		forwardErrors.WithLabelValues(request.metricModel(), strconv.Itoa(resp.StatusCode)).Inc()
+	}
 
-	// Process the response
-	respPayload, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Failed to read response: %v\n", err)
+	// Hand the event stream over to the HTTP handler, which relays it and closes the body
+	if request.Stream && resp.StatusCode == http.StatusOK {
+		log.Printf("Streaming response from service: %s", Name)
+		streaming = true
+		request.respond(Response{
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header,
+			Stream: cancelOnClose{ReadCloser: resp.Body, cancel: func() {
+				cancel()
+				limiter.release(policy.MaxInFlight)
+			}},
+		})
 		return
 	}
+	defer cancel()
+	defer resp.Body.Close()
+
+	// Process the response, already read within the timeout
+	respPayload, _ := ioutil.ReadAll(resp.Body)
 
-	log.Printf("Response Payload from service: %s", string(respPayload))
+	log.Printf("Response Payload from service (status %d): %s", resp.StatusCode, string(respPayload))
+	request.respond(Response{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       respPayload,
+	})
 	log.Println("Response sent back to original sender")
 }
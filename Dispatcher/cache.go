@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	servingv1 "knative.dev/serving/pkg/apis/serving/v1"
+	servingclientset "knative.dev/serving/pkg/client/clientset/versioned"
+	servinginformers "knative.dev/serving/pkg/client/informers/externalversions"
+	servinglisters "knative.dev/serving/pkg/client/listers/serving/v1"
+)
+
+const (
+	cacheResync      = 10 * time.Minute // full resync of the informers, watch events keep the cache current in between
+	cacheSyncTimeout = 30 * time.Second // initial list waited for at start, lookups answer 503 until it completes
+)
+
+var errCacheNotSynced = errors.New("cluster cache not synced yet")
+
+// ClusterCache answers the lookups of nodes, pods, Knative services and revisions from memory. Shared informers list the
+// cluster once and keep the cache current with watch events, so dispatching a group does not hit the API server.
+// Objects returned by the cache are shared and must not be modified.
+type ClusterCache struct {
+	mu        sync.Mutex
+	synced    bool
+	hasSynced []cache.InformerSynced // nil until the informers are started
+	nodes     corelisters.NodeLister
+	pods      corelisters.PodLister
+	services  servinglisters.ServiceLister
+	revisions servinglisters.RevisionLister
+}
+
+var clusterCache = &ClusterCache{}
+
+// Start lists the cluster and starts watching it, lookups start the informers themselves if it failed
+func (c *ClusterCache) Start() {
+	c.mu.Lock()
+	err := c.start()
+	hasSynced := c.hasSynced
+	c.mu.Unlock()
+	if err != nil {
+		log.Printf("Error starting cluster cache: %v, retrying on the next lookup", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cacheSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(ctx.Done(), hasSynced...) {
+		log.Printf("Cluster cache not synced after %s, lookups answer 503 until it is", cacheSyncTimeout)
+	}
+}
+
+// start starts the informers once, they keep running and retry their list until it succeeds. c.mu must be held
+func (c *ClusterCache) start() error {
+	if c.hasSynced != nil {
+		return nil
+	}
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return newDispatchError(http.StatusInternalServerError, "create in-cluster config", err)
+	}
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return newDispatchError(http.StatusInternalServerError, "create clientset", err)
+	}
+	servingClient, err := servingclientset.NewForConfig(config)
+	if err != nil {
+		return newDispatchError(http.StatusInternalServerError, "create Knative serving clientset", err)
+	}
+
+	kubeFactory := informers.NewSharedInformerFactory(kubeClient, cacheResync)
+	servingFactory := servinginformers.NewSharedInformerFactory(servingClient, cacheResync)
+	nodes := kubeFactory.Core().V1().Nodes()
+	pods := kubeFactory.Core().V1().Pods()
+	services := servingFactory.Serving().V1().Services()
+	revisions := servingFactory.Serving().V1().Revisions()
+	c.hasSynced = []cache.InformerSynced{ // informers must be requested before the factories start
+		nodes.Informer().HasSynced,
+		pods.Informer().HasSynced,
+		services.Informer().HasSynced,
+		revisions.Informer().HasSynced,
+	}
+	c.nodes, c.pods, c.services, c.revisions = nodes.Lister(), pods.Lister(), services.Lister(), revisions.Lister()
+
+	stop := make(chan struct{}) // never closed, the informers run as long as the Dispatcher
+	kubeFactory.Start(stop)
+	servingFactory.Start(stop)
+	return nil
+}
+
+// ensure starts the informers if needed and fails with 503 until their initial list completed
+func (c *ClusterCache) ensure() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.synced {
+		return nil
+	}
+	if err := c.start(); err != nil {
+		return err
+	}
+	for _, hasSynced := range c.hasSynced {
+		if !hasSynced() {
+			return newDispatchError(http.StatusServiceUnavailable, "look up cluster cache", errCacheNotSynced)
+		}
+	}
+	c.synced = true
+	log.Printf("Cluster cache synced")
+	return nil
+}
+
+// Nodes returns every node of the cluster
+func (c *ClusterCache) Nodes() ([]*v1.Node, error) {
+	if err := c.ensure(); err != nil {
+		return nil, err
+	}
+	return c.nodes.List(labels.Everything())
+}
+
+// Pods returns every pod of the cluster, their requests tell the MIG slices in use
+func (c *ClusterCache) Pods() ([]*v1.Pod, error) {
+	if err := c.ensure(); err != nil {
+		return nil, err
+	}
+	return c.pods.List(labels.Everything())
+}
+
+// Services returns the Knative services of a namespace matching a label selector, "" for all namespaces
+func (c *ClusterCache) Services(namespace string, selector labels.Selector) ([]*servingv1.Service, error) {
+	if err := c.ensure(); err != nil {
+		return nil, err
+	}
+	if namespace == "" {
+		return c.services.List(selector)
+	}
+	return c.services.Services(namespace).List(selector)
+}
+
+// Service returns a Knative service, nil if it does not exist
+func (c *ClusterCache) Service(namespace, name string) (*servingv1.Service, error) {
+	if err := c.ensure(); err != nil {
+		return nil, err
+	}
+	service, err := c.services.Services(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return service, err
+}
+
+// LatestRevision returns the latest revision created for a service, nil if it is not known yet
+func (c *ClusterCache) LatestRevision(service *servingv1.Service) *servingv1.Revision {
+	name := service.Status.LatestCreatedRevisionName
+	if name == "" || c.ensure() != nil {
+		return nil
+	}
+	revision, err := c.revisions.Revisions(service.Namespace).Get(name)
+	if err != nil {
+		return nil
+	}
+	return revision
+}
+
+// revisionProgress describes why the latest revision of a service is not ready, ex. an image pull error
+func revisionProgress(service *servingv1.Service) string {
+	revision := clusterCache.LatestRevision(service)
+	if revision == nil {
+		return "no revision yet"
+	}
+	for _, condition := range revision.Status.Conditions {
+		if condition.Type == "Ready" && condition.Reason != "" {
+			return fmt.Sprintf("revision %s: %s %s", revision.Name, condition.Reason, condition.Message)
+		}
+	}
+	return "revision " + revision.Name + " starting"
+}
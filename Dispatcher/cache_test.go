@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestClusterCacheNotSynced(t *testing.T) {
+	listed := false
+	c := &ClusterCache{hasSynced: []cache.InformerSynced{func() bool { return true }, func() bool { return listed }}}
+
+	var dispatchErr *DispatchError
+	if err := c.ensure(); !errors.As(err, &dispatchErr) || dispatchErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("lookup before the initial list: %v, want 503", err)
+	}
+	listed = true
+	if err := c.ensure(); err != nil || !c.synced {
+		t.Errorf("lookup after the initial list: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	servingv1 "knative.dev/serving/pkg/apis/serving/v1"
+)
+
+const (
+	freeSliceLabelPrefix = "kubecomp.com/status-gpu-" // kubecomp.com/status-gpu-<gpu>-<profile>-free, free slices published by the GPU reporter
+	freeSliceLabelSuffix = "-free"
+	maxMigLabel          = "kubecomp.com/max-mig" // largest profile the GPU reporter says the node can offer after a reconfiguration
+	migResourcePrefix    = "nvidia.com/mig-"
+)
+
+var sliceComputePattern = regexp.MustCompile(`mig-(\d+)g\.`)
+
+// SliceCapacity counts the MIG slices per profile a new service may take
+type SliceCapacity struct {
+	Free           map[string]int // slices configured and not requested by any pod
+	Reconfigurable map[string]int // profiles nodes can offer once the reconfig controller repartitions their free GPUs
+}
+
+// sliceCapacity computes the free MIG slices of the cluster: the allocatable slices of each node minus the requests of
+// its pods, capped by the GPU reporter's labels on nodes running it, since the labels lag behind pods just bound.
+// Slices requested by pods not scheduled yet, ex. a service just created, are taken off the total as well.
+func sliceCapacity(nodes []*v1.Node, pods []*v1.Pod) SliceCapacity {
+	capacity := SliceCapacity{Free: make(map[string]int), Reconfigurable: make(map[string]int)}
+	requested := make(map[string]map[string]int) // by node name, "" for pods not scheduled yet
+	for _, pod := range pods {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		if requested[pod.Spec.NodeName] == nil {
+			requested[pod.Spec.NodeName] = make(map[string]int)
+		}
+		for migConfig, count := range podSlices(pod) {
+			requested[pod.Spec.NodeName][migConfig] += count
+		}
+	}
+
+	for _, node := range nodes {
+		reported, ok := reportedFreeSlices(node)
+		for _, migConfig := range migConfigList {
+			quantity, allocatable := node.Status.Allocatable[v1.ResourceName(migConfig)]
+			if !allocatable {
+				continue
+			}
+			free := max(int(quantity.Value())-requested[node.Name][migConfig], 0)
+			if ok {
+				free = min(free, reported[migConfig]) // a profile without a label has no free slice left
+			}
+			capacity.Free[migConfig] += free
+		}
+		if maxMig := node.Labels[maxMigLabel]; maxMig != "" {
+			for _, migConfig := range migConfigList {
+				if sliceWithin(migConfig, migResourcePrefix+maxMig) {
+					capacity.Reconfigurable[migConfig]++
+				}
+			}
+		}
+	}
+	for migConfig, count := range requested[""] {
+		capacity.Free[migConfig] = max(capacity.Free[migConfig]-count, 0)
+	}
+	return capacity
+}
+
+// reportedFreeSlices reads the free slices of a node from the GPU reporter's labels, false if the node has none
+func reportedFreeSlices(node *v1.Node) (map[string]int, bool) {
+	free := make(map[string]int)
+	reported := node.Labels[maxMigLabel] != ""
+	for key, value := range node.Labels {
+		if !strings.HasPrefix(key, freeSliceLabelPrefix) || !strings.HasSuffix(key, freeSliceLabelSuffix) {
+			continue
+		}
+		reported = true
+		// <gpu>-<profile>, ex. 0-1g.5gb
+		_, profile, ok := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(key, freeSliceLabelPrefix), freeSliceLabelSuffix), "-")
+		count, err := strconv.Atoi(value)
+		if !ok || err != nil {
+			log.Printf("Invalid free slice label %s=%s on node %s", key, value, node.Name)
+			continue
+		}
+		free[migResourcePrefix+profile] += count
+	}
+	return free, reported
+}
+
+// podSlices counts the MIG slices requested by the containers of a pod
+func podSlices(pod *v1.Pod) map[string]int {
+	slices := make(map[string]int)
+	for _, container := range pod.Spec.Containers {
+		for _, migConfig := range migConfigList {
+			quantity, ok := container.Resources.Requests[v1.ResourceName(migConfig)]
+			if !ok {
+				quantity, ok = container.Resources.Limits[v1.ResourceName(migConfig)] // requests default to limits
+			}
+			if ok {
+				slices[migConfig] += int(quantity.Value())
+			}
+		}
+	}
+	return slices
+}
+
+// serviceSlices counts the MIG slices a Knative service requests per replica
+func serviceSlices(service *servingv1.Service) map[string]int {
+	slices := make(map[string]int)
+	for _, container := range service.Spec.Template.Spec.Containers {
+		for _, migConfig := range migConfigList {
+			if quantity, ok := container.Resources.Limits[v1.ResourceName(migConfig)]; ok {
+				slices[migConfig] += int(quantity.Value())
+			}
+		}
+	}
+	return slices
+}
+
+// sliceWithin reports whether a MIG profile is no larger than another in compute and memory, ex. mig-2g.10gb within mig-3g.20gb
+func sliceWithin(migConfig, largest string) bool {
+	return sliceCompute(migConfig) <= sliceCompute(largest) && sliceMemoryGB(migConfig) <= sliceMemoryGB(largest)
+}
+
+// sliceCompute parses the compute slices of a MIG profile, ex. 3 for nvidia.com/mig-3g.20gb
+func sliceCompute(migConfig string) int {
+	matches := sliceComputePattern.FindStringSubmatch(migConfig)
+	if len(matches) != 2 {
+		return 0
+	}
+	compute, _ := strconv.Atoi(matches[1])
+	return compute
+}
+
+// limit caps the slices of every profile by a tenant's remaining quota
+func (c SliceCapacity) limit(quota map[string]int) {
+	for _, slices := range []map[string]int{c.Free, c.Reconfigurable} {
+		for migConfig := range slices {
+			slices[migConfig] = min(slices[migConfig], quota[migConfig])
+		}
+	}
+}
+
+// chooseSlice picks a free slice that holds the model, falling back to a larger free slice when the smallest profile
+// is exhausted (see selectSlice), then to a profile a node can offer after a reconfiguration. It reports whether the
+// service relies on a reconfiguration, and returns "" when no slice holds the model.
+func chooseSlice(capacity SliceCapacity, profile ModelProfile, minProfile string, slo float64) (string, bool) {
+	if free := selectSlice(capacity.Free, profile, minProfile, slo); free != "" {
+		return free, false
+	}
+	if reconfigurable := selectSlice(capacity.Reconfigurable, profile, minProfile, slo); reconfigurable != "" {
+		log.Printf("No free slice holds the model, relying on a reconfiguration to %s", reconfigurable)
+		return reconfigurable, true
+	}
+	return "", false
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	mig1g = "nvidia.com/mig-1g.5gb"
+	mig2g = "nvidia.com/mig-2g.10gb"
+	mig3g = "nvidia.com/mig-3g.20gb"
+	mig7g = "nvidia.com/mig-7g.40gb"
+)
+
+func testNode(name string, labels map[string]string, allocatable map[string]int64) *v1.Node {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+	node.Status.Allocatable = v1.ResourceList{}
+	for migConfig, count := range allocatable {
+		node.Status.Allocatable[v1.ResourceName(migConfig)] = *resource.NewQuantity(count, resource.DecimalSI)
+	}
+	return node
+}
+
+func testPod(nodeName string, phase v1.PodPhase, limits map[string]int64) *v1.Pod {
+	container := v1.Container{Resources: v1.ResourceRequirements{Limits: v1.ResourceList{}}}
+	for migConfig, count := range limits {
+		container.Resources.Limits[v1.ResourceName(migConfig)] = *resource.NewQuantity(count, resource.DecimalSI)
+	}
+	return &v1.Pod{Spec: v1.PodSpec{NodeName: nodeName, Containers: []v1.Container{container}}, Status: v1.PodStatus{Phase: phase}}
+}
+
+func TestSliceCapacity(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []*v1.Node
+		pods  []*v1.Pod
+		want  SliceCapacity
+	}{
+		{
+			name:  "allocatable minus the requests of the node's pods",
+			nodes: []*v1.Node{testNode("n1", nil, map[string]int64{mig1g: 7})},
+			pods: []*v1.Pod{
+				testPod("n1", v1.PodRunning, map[string]int64{mig1g: 2}),
+				testPod("n1", v1.PodSucceeded, map[string]int64{mig1g: 3}), // done, holds nothing
+				testPod("n2", v1.PodRunning, map[string]int64{mig1g: 4}),   // another node
+			},
+			want: SliceCapacity{Free: map[string]int{mig1g: 5}, Reconfigurable: map[string]int{}},
+		},
+		{
+			name: "reporter labels cap the allocatable slices",
+			nodes: []*v1.Node{testNode("n1", map[string]string{
+				"kubecomp.com/status-gpu-0-3g.20gb-free": "1",
+				"kubecomp.com/status-gpu-1-3g.20gb-free": "1",
+				"kubecomp.com/status-gpu-1-1g.5gb-free":  "2",
+			}, map[string]int64{mig3g: 4, mig1g: 3, mig2g: 1})},
+			pods: []*v1.Pod{testPod("n1", v1.PodRunning, map[string]int64{mig3g: 2})}, // counted by the reporter already
+			want: SliceCapacity{Free: map[string]int{mig3g: 2, mig1g: 2, mig2g: 0}, Reconfigurable: map[string]int{}},
+		},
+		{
+			name: "pods bound since the last report",
+			nodes: []*v1.Node{testNode("n1", map[string]string{
+				"kubecomp.com/status-gpu-0-3g.20gb-free": "2",
+			}, map[string]int64{mig3g: 2})},
+			pods: []*v1.Pod{testPod("n1", v1.PodPending, map[string]int64{mig3g: 1})}, // bound, not running yet
+			want: SliceCapacity{Free: map[string]int{mig3g: 1}, Reconfigurable: map[string]int{}},
+		},
+		{
+			name:  "pending pods take slices off the total",
+			nodes: []*v1.Node{testNode("n1", nil, map[string]int64{mig2g: 3})},
+			pods:  []*v1.Pod{testPod("", v1.PodPending, map[string]int64{mig2g: 1, mig3g: 1})},
+			want:  SliceCapacity{Free: map[string]int{mig2g: 2, mig3g: 0}, Reconfigurable: map[string]int{}},
+		},
+		{
+			name: "max-mig marks the profiles a reconfiguration can offer",
+			nodes: []*v1.Node{
+				testNode("n1", map[string]string{maxMigLabel: "3g.20gb"}, nil),
+				testNode("n2", map[string]string{maxMigLabel: "1g.5gb"}, nil),
+			},
+			want: SliceCapacity{
+				Free:           map[string]int{},
+				Reconfigurable: map[string]int{mig1g: 2, mig2g: 1, mig3g: 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sliceCapacity(tt.nodes, tt.pods); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sliceCapacity() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChooseSlice(t *testing.T) {
+	model8B := ModelProfile{MemoryGB: 18, TokensPerSecond: map[string]float64{mig3g: 45, mig7g: 90}}
+	model1B := ModelProfile{MemoryGB: 3}
+
+	tests := []struct {
+		name            string
+		capacity        SliceCapacity
+		profile         ModelProfile
+		minProfile      string
+		slo             float64
+		wantSlice       string
+		wantReconfigure bool
+	}{
+		{
+			name:      "smallest free slice holding the model",
+			capacity:  SliceCapacity{Free: map[string]int{mig1g: 1, mig3g: 1, mig7g: 1}},
+			profile:   model8B,
+			wantSlice: mig3g,
+		},
+		{
+			name:      "larger free slice when the smallest profile is exhausted",
+			capacity:  SliceCapacity{Free: map[string]int{mig1g: 1, mig3g: 0, mig7g: 1}},
+			profile:   model8B,
+			wantSlice: mig7g,
+		},
+		{
+			name:      "larger free slice meeting the SLO",
+			capacity:  SliceCapacity{Free: map[string]int{mig3g: 1, mig7g: 1}},
+			profile:   model8B,
+			slo:       0.02, // 50 tokens per second
+			wantSlice: mig7g,
+		},
+		{
+			name:       "no smaller than the minimum profile",
+			capacity:   SliceCapacity{Free: map[string]int{mig1g: 1, mig2g: 1}},
+			profile:    model1B,
+			minProfile: mig2g,
+			wantSlice:  mig2g,
+		},
+		{
+			name:            "reconfiguration when no free slice holds the model",
+			capacity:        SliceCapacity{Free: map[string]int{mig1g: 3}, Reconfigurable: map[string]int{mig1g: 1, mig3g: 1}},
+			profile:         model8B,
+			wantSlice:       mig3g,
+			wantReconfigure: true,
+		},
+		{
+			name:      "nothing when no slice holds the model",
+			capacity:  SliceCapacity{Free: map[string]int{mig1g: 3}, Reconfigurable: map[string]int{mig2g: 1}},
+			profile:   model8B,
+			wantSlice: "",
+		},
+		{
+			name:      "nothing without capacity",
+			capacity:  SliceCapacity{},
+			profile:   model1B,
+			wantSlice: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slice, reconfigure := chooseSlice(tt.capacity, tt.profile, tt.minProfile, tt.slo)
+			if slice != tt.wantSlice || reconfigure != tt.wantReconfigure {
+				t.Errorf("chooseSlice() = %q, %v, want %q, %v", slice, reconfigure, tt.wantSlice, tt.wantReconfigure)
+			}
+		})
+	}
+}
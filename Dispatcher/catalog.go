@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	defaultCatalogPath           = "/etc/dispatcher/catalog.yaml" // mounted from the model-catalog ConfigMap
+	defaultCatalogReloadInterval = 10 * time.Second
+	tgiImage                     = "ghcr.io/huggingface/text-generation-inference:2.2.0"
+)
+
+// CatalogEntry describes how to serve a model
+type CatalogEntry struct {
+	Image          string            `json:"image"`
+	Command        []string          `json:"command"`
+	Args           []string          `json:"args"`
+	Env            map[string]string `json:"env"`        // required env, the request env is added on top
+	Port           int32             `json:"port"`       // container port the runtime listens on, Knative's default 8080 if unset
+	MinProfile     string            `json:"minProfile"` // smallest MIG profile able to serve the model, ex. nvidia.com/mig-2g.10gb
+	CPU            int               `json:"cpu"`        // millicores
+	Memory         int               `json:"memory"`     // MiB
+	VolumeMounts   []v1.VolumeMount  `json:"volumeMounts"`
+	Volumes        []v1.Volume       `json:"volumes"`
+	ReadinessProbe *v1.Probe         `json:"readinessProbe"`
+	MinScale       int               `json:"minScale"` // pods kept running, >0 keeps the service warm until it is idle for the idle TTL
+	MaxScale       int               `json:"maxScale"` // upper bound of the Knative autoscaler, 0 is unbounded
+
+	Variants map[string]CatalogEntry `json:"variants"` // per variant overrides, ex. awq: {env: {QUANTIZE: awq}}
+}
+
+// ModelCatalog maps model ids (or path patterns like meta-llama/*) to their serving runtime
+type ModelCatalog struct {
+	Default CatalogEntry            `json:"default"` // runtime of models without an entry
+	Models  map[string]CatalogEntry `json:"models"`
+}
+
+// CatalogStore holds the current catalog and reloads it when the mounted file changes
+type CatalogStore struct {
+	mu      sync.RWMutex
+	catalog ModelCatalog
+	path    string
+	raw     []byte
+}
+
+// defaultCatalog reproduces the serving runtime used before the catalog existed: TGI with the model cache on a PVC
+var defaultCatalog = ModelCatalog{
+	Default: CatalogEntry{
+		Image:      tgiImage,
+		MinProfile: migConfigList[0], // models of unknown size, ex. openai-community/gpt2, take the smallest slice
+		CPU:        defaultCPU,
+		Memory:     defaultMemory,
+		VolumeMounts: []v1.VolumeMount{{
+			Name:      "disk-volume",
+			MountPath: "/data",
+		}},
+		Volumes: []v1.Volume{{
+			Name: "disk-volume",
+			VolumeSource: v1.VolumeSource{
+				PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+					ClaimName: "knative-pv-claim", // Use the PVC created in your cluster
+					ReadOnly:  false,              // Set to false if you need write access
+				},
+			},
+		}},
+	},
+	Models: map[string]CatalogEntry{
+		"test": {
+			Image: "ghcr.io/deeeelin/knative-service:latest",
+		},
+	},
+}
+
+var modelCatalog = NewCatalogStore()
+
+func NewCatalogStore() *CatalogStore {
+	catalogPath := os.Getenv("MODEL_CATALOG")
+	if catalogPath == "" {
+		catalogPath = defaultCatalogPath
+	}
+	store := &CatalogStore{catalog: defaultCatalog, path: catalogPath}
+	store.reload()
+	return store
+}
+
+// Watch polls the catalog file and reloads it on change, ConfigMap updates reach the mounted file within a minute
+func (s *CatalogStore) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.reload()
+	}
+}
+
+func (s *CatalogStore) reload() {
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		if s.raw == nil {
+			log.Printf("Could not read model catalog %s: %v, use default catalog", s.path, err)
+			s.raw = []byte{}
+		}
+		return
+	}
+	if bytes.Equal(raw, s.raw) {
+		return
+	}
+	s.raw = raw
+
+	var catalog ModelCatalog
+	if err := yaml.Unmarshal(raw, &catalog); err != nil {
+		log.Printf("Invalid model catalog %s: %v, keeping previous catalog", s.path, err)
+		return
+	}
+	if catalog.Default.Image == "" {
+		catalog.Default = defaultCatalog.Default
+	}
+
+	s.mu.Lock()
+	s.catalog = catalog
+	s.mu.Unlock()
+	log.Printf("Loaded model catalog with %d models", len(catalog.Models))
+}
+
+// Lookup returns the runtime of a model variant: its exact entry, else the most specific matching pattern (the longest,
+// ex. meta-llama/Llama-3* over meta-llama/*), else the default, with the fields set by the variant overriding it.
+// Unset fields of an entry are taken from the default.
+func (s *CatalogStore) Lookup(modelID, variant string) CatalogEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.match(modelID)
+	def := s.catalog.Default
+	if !ok {
+		entry = def
+	}
+	if override, ok := entry.Variants[variant]; ok && variant != "" {
+		entry = entry.overlay(override)
+	}
+	if entry.Image == "" {
+		entry.Image = def.Image
+	}
+	if entry.Command == nil {
+		entry.Command = def.Command
+	}
+	if entry.Args == nil {
+		entry.Args = def.Args
+	}
+	if len(def.Env) > 0 {
+		// env values are merged, the entry's own values win
+		env := make(map[string]string, len(def.Env)+len(entry.Env))
+		for key, value := range def.Env {
+			env[key] = value
+		}
+		for key, value := range entry.Env {
+			env[key] = value
+		}
+		entry.Env = env
+	}
+	if entry.Port <= 0 {
+		entry.Port = def.Port
+	}
+	if entry.MinProfile == "" {
+		entry.MinProfile = def.MinProfile
+	}
+	if entry.CPU <= 0 {
+		entry.CPU = def.CPU
+	}
+	if entry.Memory <= 0 {
+		entry.Memory = def.Memory
+	}
+	if entry.MinScale <= 0 {
+		entry.MinScale = def.MinScale
+	}
+	if entry.MaxScale <= 0 {
+		entry.MaxScale = def.MaxScale
+	}
+	if entry.ReadinessProbe == nil {
+		entry.ReadinessProbe = def.ReadinessProbe
+	}
+	if entry.VolumeMounts == nil && entry.Volumes == nil {
+		entry.VolumeMounts, entry.Volumes = def.VolumeMounts, def.Volumes
+	}
+	if entry.CPU <= 0 {
+		entry.CPU = defaultCPU
+	}
+	if entry.Memory <= 0 {
+		entry.Memory = defaultMemory
+	}
+	return entry
+}
+
+// Has reports whether a model has its own entry or matches a pattern, rather than running the default
+func (s *CatalogStore) Has(modelID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.match(modelID)
+	return ok
+}
+
+// match returns the exact entry of a model, else the most specific matching pattern, s.mu must be held
+func (s *CatalogStore) match(modelID string) (CatalogEntry, bool) {
+	if entry, ok := s.catalog.Models[modelID]; ok {
+		return entry, true
+	}
+	var entry CatalogEntry
+	ok, best := false, ""
+	for pattern, patternEntry := range s.catalog.Models {
+		if matched, _ := path.Match(pattern, modelID); !matched {
+			continue
+		}
+		// map order is random, pick by length then name so every lookup of a model agrees
+		if !ok || len(pattern) > len(best) || (len(pattern) == len(best) && pattern < best) {
+			entry, ok, best = patternEntry, true, pattern
+		}
+	}
+	return entry, ok
+}
+
+// overlay returns the entry with the fields set in override replacing its own, env values are merged
+func (e CatalogEntry) overlay(override CatalogEntry) CatalogEntry {
+	if override.Image != "" {
+		e.Image = override.Image
+	}
+	if override.Command != nil {
+		e.Command = override.Command
+	}
+	if override.Args != nil {
+		e.Args = override.Args
+	}
+	if len(override.Env) > 0 {
+		env := make(map[string]string, len(e.Env)+len(override.Env))
+		for key, value := range e.Env {
+			env[key] = value
+		}
+		for key, value := range override.Env {
+			env[key] = value
+		}
+		e.Env = env
+	}
+	if override.Port > 0 {
+		e.Port = override.Port
+	}
+	if override.MinProfile != "" {
+		e.MinProfile = override.MinProfile
+	}
+	if override.CPU > 0 {
+		e.CPU = override.CPU
+	}
+	if override.Memory > 0 {
+		e.Memory = override.Memory
+	}
+	if override.VolumeMounts != nil || override.Volumes != nil {
+		e.VolumeMounts, e.Volumes = override.VolumeMounts, override.Volumes
+	}
+	if override.ReadinessProbe != nil {
+		e.ReadinessProbe = override.ReadinessProbe
+	}
+	if override.MinScale > 0 {
+		e.MinScale = override.MinScale
+	}
+	if override.MaxScale > 0 {
+		e.MaxScale = override.MaxScale
+	}
+	return e
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCatalogLookup(t *testing.T) {
+	store := &CatalogStore{catalog: ModelCatalog{
+		Default: CatalogEntry{
+			Image:      "tgi",
+			Command:    []string{"text-generation-launcher"},
+			Args:       []string{"--json-output"},
+			Env:        map[string]string{"PORT": "8080", "NUM_SHARD": "1"},
+			Port:       8080,
+			MinProfile: mig1g,
+			CPU:        1000,
+			Memory:     1024,
+		},
+		Models: map[string]CatalogEntry{
+			"meta-llama/*": {MinProfile: mig3g, Env: map[string]string{"NUM_SHARD": "2"}},
+			"meta-llama/Llama-3*": {
+				Image:    "vllm",
+				Command:  []string{"vllm", "serve"},
+				Port:     8000,
+				Variants: map[string]CatalogEntry{"awq": {Env: map[string]string{"QUANTIZE": "awq"}}},
+			},
+		},
+	}}
+
+	tests := []struct {
+		name    string
+		modelID string
+		variant string
+		want    CatalogEntry
+	}{
+		{
+			name:    "model without an entry",
+			modelID: "google/gemma-2b",
+			want: CatalogEntry{Image: "tgi", Command: []string{"text-generation-launcher"}, Args: []string{"--json-output"},
+				Env: map[string]string{"PORT": "8080", "NUM_SHARD": "1"}, Port: 8080, MinProfile: mig1g, CPU: 1000, Memory: 1024},
+		},
+		{
+			name:    "unset fields taken from the default",
+			modelID: "meta-llama/Meta-Llama-3.1-8B",
+			want: CatalogEntry{Image: "tgi", Command: []string{"text-generation-launcher"}, Args: []string{"--json-output"},
+				Env: map[string]string{"PORT": "8080", "NUM_SHARD": "2"}, Port: 8080, MinProfile: mig3g, CPU: 1000, Memory: 1024},
+		},
+		{
+			name:    "longest pattern and its variant",
+			modelID: "meta-llama/Llama-3.2-1B",
+			variant: "awq",
+			want: CatalogEntry{Image: "vllm", Command: []string{"vllm", "serve"}, Args: []string{"--json-output"},
+				Env: map[string]string{"PORT": "8080", "NUM_SHARD": "1", "QUANTIZE": "awq"}, Port: 8000, MinProfile: mig1g, CPU: 1000, Memory: 1024},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := store.Lookup(tt.modelID, tt.variant)
+			got.Variants = nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Lookup(%q, %q) = %+v, want %+v", tt.modelID, tt.variant, got, tt.want)
+			}
+		})
+	}
+	if env := store.catalog.Default.Env; len(env) != 2 {
+		t.Errorf("Lookup() changed the default env to %v", env)
+	}
+}
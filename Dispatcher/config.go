@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	defaultConfigPath        = "/etc/dispatcher/config.yaml" // mounted from the dispatcher-config ConfigMap
+	defaultBatchMaxSize      = 1
+	defaultBatchMaxWait      = 100 * time.Millisecond
+	defaultBatchTickInterval = 10 * time.Millisecond
+	defaultCPU               = 10000  // millicores, TGI requires massive ammount of cpu and memory
+	defaultMemory            = 102400 // MiB
+	defaultBytesPerParameter = 2      // fp16 weights
+	memoryOverhead           = 1.2    // KV cache and activations on top of the weights
+)
+
+// parameterCountPattern finds the model size in a model id, ex. 8 in meta-llama/Meta-Llama-3.1-8B
+var parameterCountPattern = regexp.MustCompile(`(?i)(?:^|[-_/])(\d+(?:\.\d+)?)b(?:$|[-_])`)
+
+// Config is the Dispatcher configuration file
+type Config struct {
+	Batching       BatchingConfig          `json:"batching"`
+	Preprocessing  PreprocessingConfig     `json:"preprocessing"`
+	Profiles       map[string]ModelProfile `json:"profiles"` // keyed by MODEL_ID
+	Queueing       QueueingConfig          `json:"queueing"`
+	Processing     ProcessingConfig        `json:"processing"`
+	Services       ServicesConfig          `json:"services"`
+	Forwarding     ForwardingConfig        `json:"forwarding"`
+	Ingress        IngressConfig           `json:"ingress"`
+	Secrets        SecretsConfig           `json:"secrets"`
+	Scheduling     SchedulingConfig        `json:"scheduling"`
+	Shutdown       ShutdownConfig          `json:"shutdown"`
+	LeaderElection LeaderElectionConfig    `json:"leaderElection"`
+	Routing        RoutingConfig           `json:"routing"`
+	Results        ResultsConfig           `json:"results"`
+}
+
+// LeaderElectionConfig is the Lease the replicas compete for, its holder collects the idle services
+type LeaderElectionConfig struct {
+	LeaseName     string          `json:"leaseName"`     // Lease in the namespace of the Dispatcher
+	LeaseDuration metav1.Duration `json:"leaseDuration"` // how long the other replicas wait before taking over from a leader that is gone
+	RenewDeadline metav1.Duration `json:"renewDeadline"` // the leader steps down if it could not renew the Lease for this long
+	RetryPeriod   metav1.Duration `json:"retryPeriod"`   // between attempts to acquire or renew the Lease
+}
+
+// ResultsConfig controls how long the results of asynchronous requests are kept
+type ResultsConfig struct {
+	TTL metav1.Duration `json:"ttl"` // finished results are evicted this long after their last update
+}
+
+// ShutdownConfig controls how the Dispatcher drains its requests when terminated
+type ShutdownConfig struct {
+	DrainTimeout metav1.Duration `json:"drainTimeout"` // admitted requests not handed to a service by then are answered with 503
+}
+
+// SchedulingConfig orders the complete groups waiting to be processed
+type SchedulingConfig struct {
+	Priorities      []string           `json:"priorities"`      // priority classes, most urgent first
+	DefaultPriority string             `json:"defaultPriority"` // class of requests without a priority
+	AgingInterval   metav1.Duration    `json:"agingInterval"`   // a waiting group moves up one class per interval, so no class starves
+	Weights         map[string]float64 `json:"weights"`         // share of a flow (tenant, or MODEL_ID of anonymous requests) within a class, 1 if unset
+}
+
+// SecretsConfig lists the env keys holding tokens
+type SecretsConfig struct {
+	SensitiveKeys []string `json:"sensitiveKeys"` // keys or patterns like *_TOKEN, redacted from logs and injected from Secrets
+}
+
+// IngressConfig decides how forwarded requests reach the services
+type IngressConfig struct {
+	Mode         string `json:"mode"`         // "gateway" (default) or "address" to use the status.address.url of the services
+	GatewayURL   string `json:"gatewayURL"`   // cluster-local ingress gateway, ex. Kourier, Istio knative-local-gateway or Contour envoy
+	HostTemplate string `json:"hostTemplate"` // go template of the Host header, {{.Name}} and {{.Namespace}} of the service
+}
+
+// ForwardingConfig controls how requests are sent to the services
+type ForwardingConfig struct {
+	Default ForwardPolicy            `json:"default"`
+	Models  map[string]ForwardPolicy `json:"models"`  // per MODEL_ID policies, unset fields fall back to default
+	Breaker BreakerConfig            `json:"breaker"` // shared by all services
+}
+
+// ForwardPolicy bounds a forwarded request and retries it on failures that happened before the service handled it
+type ForwardPolicy struct {
+	Timeout     metav1.Duration `json:"timeout"`     // whole response, or until the first byte of a stream
+	Retries     int             `json:"retries"`     // extra attempts on connection errors, 502 and 503, negative disables retries
+	Backoff     metav1.Duration `json:"backoff"`     // base of the jittered exponential backoff between attempts
+	MaxBackoff  metav1.Duration `json:"maxBackoff"`  // upper bound of a single backoff
+	MaxInFlight int             `json:"maxInFlight"` // requests forwarded to one service at the same time, more wait by priority
+}
+
+// BreakerConfig stops forwarding to a service after consecutive failures
+type BreakerConfig struct {
+	FailureThreshold int             `json:"failureThreshold"` // consecutive failed requests that open the circuit
+	OpenDuration     metav1.Duration `json:"openDuration"`     // requests are rejected this long before a probe request is let through
+}
+
+// ServicesConfig controls the lifecycle of the Knative services serving the models
+type ServicesConfig struct {
+	ReadyTimeout metav1.Duration   `json:"readyTimeout"` // requests buffered during a cold start fail with 504 after this
+	Namespace    string            `json:"namespace"`    // namespace of the services
+	Namespaces   map[string]string `json:"namespaces"`   // per MODEL_ID namespaces, overriding namespace
+	IdleTTL      metav1.Duration   `json:"idleTTL"`      // services without requests for this long are collected
+	IdleAction   string            `json:"idleAction"`   // "delete" (default), "scaleToZero" or "none"
+}
+
+// ProcessingConfig bounds the groups whose service is decided and assigned at the same time
+type ProcessingConfig struct {
+	MaxConcurrency int `json:"maxConcurrency"` // across all models, groups of one model are always processed one at a time
+}
+
+// QueueingConfig bounds the per model request queues
+type QueueingConfig struct {
+	Default       QueuePolicy            `json:"default"`
+	Models        map[string]QueuePolicy `json:"models"`        // per MODEL_ID policies, unset fields fall back to default
+	MaxTotalDepth int                    `json:"maxTotalDepth"` // queued requests across all models before answering 503
+	MaxQueues     int                    `json:"maxQueues"`     // queues (per model and tenant) at the same time, requests for another model are answered with 503
+	RetryAfter    metav1.Duration        `json:"retryAfter"`    // Retry-After sent with 429 and 503 answers
+}
+
+// QueuePolicy bounds the queue of a model
+type QueuePolicy struct {
+	Depth        int             `json:"depth"`        // queued requests before answering 429
+	MaxQueueTime metav1.Duration `json:"maxQueueTime"` // requests waiting longer are dropped with 503
+}
+
+// ModelProfile describes the GPU memory a model needs and how fast it runs on each MIG slice
+type ModelProfile struct {
+	ParametersB       float64            `json:"parametersB"`       // model size in billions of parameters, guessed from the model id if unset
+	BytesPerParameter float64            `json:"bytesPerParameter"` // 2 for fp16, 1 for 8-bit quantized weights
+	MemoryGB          float64            `json:"memoryGB"`          // GPU memory footprint, overrides the estimate from the model size
+	TokensPerSecond   map[string]float64 `json:"tokensPerSecond"`   // expected decode throughput per MIG profile, ex. nvidia.com/mig-3g.20gb
+
+	Variants map[string]ModelProfile `json:"variants"` // per variant overrides, ex. awq: {memoryGB: 9}
+}
+
+// BatchingConfig defines when a forming request group of a model is flushed
+type BatchingConfig struct {
+	TickInterval metav1.Duration        `json:"tickInterval"` // how often forming groups are checked for max wait
+	Default      BatchPolicy            `json:"default"`      // policy of models without their own entry
+	Models       map[string]BatchPolicy `json:"models"`       // per MODEL_ID policies, unset fields fall back to default
+}
+
+// PreprocessingConfig lists the preprocess stages run on every complete group, in order
+type PreprocessingConfig struct {
+	Stages []StageConfig `json:"stages"`
+}
+
+// StageConfig selects a registered preprocess stage by name, options are specific to the stage
+type StageConfig struct {
+	Name    string          `json:"name"`
+	Options json.RawMessage `json:"options"`
+}
+
+// BatchPolicy flushes a group once any of its limits is reached
+type BatchPolicy struct {
+	MaxSize   int             `json:"maxSize"`   // number of requests in a group
+	MaxWait   metav1.Duration `json:"maxWait"`   // age of the oldest request in a group
+	MaxTokens int             `json:"maxTokens"` // estimated prompt tokens in a group, 0 disables the limit
+}
+
+var dispatcherConfig = loadConfig()
+
+// loadConfig reads the configuration file from DISPATCHER_CONFIG, using defaults when it is absent
+func loadConfig() Config {
+	cfg := Config{}
+
+	path := os.Getenv("DISPATCHER_CONFIG")
+	if path == "" {
+		path = defaultConfigPath
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Could not read config file %s: %v, use default config", path, err)
+	} else if err := yaml.Unmarshal(data, &cfg); err != nil {
+		log.Printf("Invalid config file %s: %v, use default config", path, err)
+		cfg = Config{}
+	}
+
+	if cfg.Batching.TickInterval.Duration <= 0 {
+		cfg.Batching.TickInterval.Duration = defaultBatchTickInterval
+	}
+	if cfg.Batching.Default.MaxSize <= 0 {
+		cfg.Batching.Default.MaxSize = defaultBatchMaxSize
+	}
+	if cfg.Batching.Default.MaxWait.Duration <= 0 {
+		cfg.Batching.Default.MaxWait.Duration = defaultBatchMaxWait
+	}
+	if cfg.Queueing.Default.Depth <= 0 {
+		cfg.Queueing.Default.Depth = defaultQueueDepth
+	}
+	if cfg.Queueing.Default.MaxQueueTime.Duration <= 0 {
+		cfg.Queueing.Default.MaxQueueTime.Duration = defaultMaxQueueTime
+	}
+	if cfg.Queueing.MaxTotalDepth <= 0 {
+		cfg.Queueing.MaxTotalDepth = defaultMaxTotalDepth
+	}
+	if cfg.Queueing.MaxQueues <= 0 {
+		cfg.Queueing.MaxQueues = defaultMaxQueues
+	}
+	if cfg.Queueing.RetryAfter.Duration <= 0 {
+		cfg.Queueing.RetryAfter.Duration = defaultRetryAfter
+	}
+	if cfg.Processing.MaxConcurrency <= 0 {
+		cfg.Processing.MaxConcurrency = defaultMaxConcurrency
+	}
+	if cfg.Services.ReadyTimeout.Duration <= 0 {
+		cfg.Services.ReadyTimeout.Duration = defaultReadyTimeout
+	}
+	if cfg.Services.IdleTTL.Duration <= 0 {
+		cfg.Services.IdleTTL.Duration = defaultIdleTTL
+	}
+	switch cfg.Services.IdleAction {
+	case idleActionDelete, idleActionScaleToZero, idleActionNone:
+	case "":
+		cfg.Services.IdleAction = idleActionDelete
+	default:
+		log.Printf("Unknown idle action %q, use %q", cfg.Services.IdleAction, idleActionNone)
+		cfg.Services.IdleAction = idleActionNone
+	}
+	if cfg.Services.Namespace == "" {
+		cfg.Services.Namespace = defaultNamespace
+	}
+	switch cfg.Ingress.Mode {
+	case ingressModeGateway, ingressModeAddress:
+	case "":
+		cfg.Ingress.Mode = ingressModeGateway
+	default:
+		log.Printf("Unknown ingress mode %q, use %q", cfg.Ingress.Mode, ingressModeGateway)
+		cfg.Ingress.Mode = ingressModeGateway
+	}
+	if len(cfg.Scheduling.Priorities) == 0 {
+		cfg.Scheduling.Priorities = defaultPriorities
+	}
+	if _, ok := cfg.priorityRank(cfg.Scheduling.DefaultPriority); !ok {
+		cfg.Scheduling.DefaultPriority = cfg.Scheduling.Priorities[len(cfg.Scheduling.Priorities)/2]
+	}
+	if cfg.Scheduling.AgingInterval.Duration <= 0 {
+		cfg.Scheduling.AgingInterval.Duration = defaultAgingInterval
+	}
+	if len(cfg.Secrets.SensitiveKeys) == 0 {
+		cfg.Secrets.SensitiveKeys = defaultSensitiveKeys
+	}
+	if cfg.Ingress.GatewayURL == "" {
+		cfg.Ingress.GatewayURL = defaultGatewayURL
+	}
+	if cfg.Ingress.HostTemplate == "" {
+		cfg.Ingress.HostTemplate = defaultHostTemplate
+	}
+	if cfg.Forwarding.Default.Timeout.Duration <= 0 {
+		cfg.Forwarding.Default.Timeout.Duration = defaultForwardTimeout
+	}
+	if cfg.Forwarding.Default.Retries == 0 {
+		cfg.Forwarding.Default.Retries = defaultForwardRetries
+	}
+	if cfg.Forwarding.Default.Backoff.Duration <= 0 {
+		cfg.Forwarding.Default.Backoff.Duration = defaultForwardBackoff
+	}
+	if cfg.Forwarding.Default.MaxBackoff.Duration <= 0 {
+		cfg.Forwarding.Default.MaxBackoff.Duration = defaultForwardMaxBackoff
+	}
+	if cfg.Forwarding.Default.MaxInFlight <= 0 {
+		cfg.Forwarding.Default.MaxInFlight = defaultMaxInFlight
+	}
+	if cfg.Forwarding.Breaker.FailureThreshold <= 0 {
+		cfg.Forwarding.Breaker.FailureThreshold = defaultBreakerThreshold
+	}
+	if cfg.Forwarding.Breaker.OpenDuration.Duration <= 0 {
+		cfg.Forwarding.Breaker.OpenDuration.Duration = defaultBreakerOpenDuration
+	}
+	if cfg.Results.TTL.Duration <= 0 {
+		cfg.Results.TTL.Duration = defaultResultTTL
+	}
+	if cfg.Shutdown.DrainTimeout.Duration <= 0 {
+		cfg.Shutdown.DrainTimeout.Duration = defaultDrainTimeout
+	}
+	if cfg.LeaderElection.LeaseName == "" {
+		cfg.LeaderElection.LeaseName = defaultLeaseName
+	}
+	if cfg.LeaderElection.LeaseDuration.Duration <= 0 {
+		cfg.LeaderElection.LeaseDuration.Duration = defaultLeaseDuration
+	}
+	if cfg.LeaderElection.RenewDeadline.Duration <= 0 {
+		cfg.LeaderElection.RenewDeadline.Duration = defaultRenewDeadline
+	}
+	if cfg.LeaderElection.RenewDeadline.Duration >= cfg.LeaderElection.LeaseDuration.Duration {
+		log.Printf("Renew deadline %s must be shorter than the lease duration %s, use %s", cfg.LeaderElection.RenewDeadline.Duration,
+			cfg.LeaderElection.LeaseDuration.Duration, cfg.LeaderElection.LeaseDuration.Duration*2/3)
+		cfg.LeaderElection.RenewDeadline.Duration = cfg.LeaderElection.LeaseDuration.Duration * 2 / 3
+	}
+	if cfg.LeaderElection.RetryPeriod.Duration <= 0 {
+		cfg.LeaderElection.RetryPeriod.Duration = defaultRetryPeriod
+	}
+	return cfg
+}
+
+// maxRequestTime is the longest a request can be served: its queue time, a cold start and its forward with retries
+func (c Config) maxRequestTime() time.Duration {
+	queueTime := c.Queueing.Default.MaxQueueTime.Duration
+	for modelID := range c.Queueing.Models {
+		queueTime = max(queueTime, c.queuePolicy(modelID).MaxQueueTime.Duration)
+	}
+	forwardTime := c.forwardPolicy("").maxDuration()
+	for modelID := range c.Forwarding.Models {
+		forwardTime = max(forwardTime, c.forwardPolicy(modelID).maxDuration())
+	}
+	return queueTime + c.Services.ReadyTimeout.Duration + forwardTime
+}
+
+// maxDuration is the longest a forward takes: every attempt timing out, with the longest backoff between them
+func (p ForwardPolicy) maxDuration() time.Duration {
+	return time.Duration(p.Retries+1)*p.Timeout.Duration + time.Duration(p.Retries)*p.MaxBackoff.Duration
+}
+
+// queuePolicy returns the queue policy of a model
+func (c Config) queuePolicy(modelID string) QueuePolicy {
+	policy := c.Queueing.Default
+	if override, ok := c.Queueing.Models[modelID]; ok {
+		if override.Depth > 0 {
+			policy.Depth = override.Depth
+		}
+		if override.MaxQueueTime.Duration > 0 {
+			policy.MaxQueueTime = override.MaxQueueTime
+		}
+	}
+	return policy
+}
+
+// priorityRank returns the rank of a priority class, 0 is the most urgent
+func (c Config) priorityRank(priority string) (int, bool) {
+	for rank, name := range c.Scheduling.Priorities {
+		if name == priority {
+			return rank, true
+		}
+	}
+	return 0, false
+}
+
+// priorityName returns the priority class of a rank
+func (c Config) priorityName(rank int) string {
+	if rank >= 0 && rank < len(c.Scheduling.Priorities) {
+		return c.Scheduling.Priorities[rank]
+	}
+	return c.Scheduling.DefaultPriority
+}
+
+// flowWeight returns the fair share weight of a flow
+func (c Config) flowWeight(flow string) float64 {
+	if weight, ok := c.Scheduling.Weights[flow]; ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// serviceNamespace returns the namespace the service of a model runs in
+func (c Config) serviceNamespace(modelID string) string {
+	if namespace, ok := c.Services.Namespaces[modelID]; ok && namespace != "" {
+		return namespace
+	}
+	return c.Services.Namespace
+}
+
+// forwardPolicy returns the forwarding policy of a model
+func (c Config) forwardPolicy(modelID string) ForwardPolicy {
+	policy := c.Forwarding.Default
+	if override, ok := c.Forwarding.Models[modelID]; ok {
+		if override.Timeout.Duration > 0 {
+			policy.Timeout = override.Timeout
+		}
+		if override.Retries != 0 {
+			policy.Retries = override.Retries
+		}
+		if override.Backoff.Duration > 0 {
+			policy.Backoff = override.Backoff
+		}
+		if override.MaxBackoff.Duration > 0 {
+			policy.MaxBackoff = override.MaxBackoff
+		}
+		if override.MaxInFlight > 0 {
+			policy.MaxInFlight = override.MaxInFlight
+		}
+	}
+	if policy.Retries < 0 {
+		policy.Retries = 0
+	}
+	return policy
+}
+
+// modelProfile returns the profile of a model variant, filling unset fields with defaults
+func (c Config) modelProfile(modelID, variant string) ModelProfile {
+	profile := c.Profiles[modelID]
+	if override, ok := profile.Variants[variant]; ok && variant != "" {
+		profile = profile.overlay(override)
+	}
+	if profile.ParametersB <= 0 {
+		if matches := parameterCountPattern.FindStringSubmatch(modelID); len(matches) == 2 {
+			profile.ParametersB, _ = strconv.ParseFloat(matches[1], 64)
+		}
+	}
+	if profile.BytesPerParameter <= 0 {
+		profile.BytesPerParameter = defaultBytesPerParameter
+	}
+	return profile
+}
+
+// overlay returns the profile with the fields set in override replacing its own
+func (p ModelProfile) overlay(override ModelProfile) ModelProfile {
+	if override.ParametersB > 0 {
+		p.ParametersB = override.ParametersB
+	}
+	if override.BytesPerParameter > 0 {
+		p.BytesPerParameter = override.BytesPerParameter
+	}
+	if override.MemoryGB > 0 {
+		p.MemoryGB = override.MemoryGB
+	}
+	if override.TokensPerSecond != nil {
+		p.TokensPerSecond = override.TokensPerSecond
+	}
+	return p
+}
+
+// footprintGB is the GPU memory the model needs to load and serve
+func (p ModelProfile) footprintGB() float64 {
+	if p.MemoryGB > 0 {
+		return p.MemoryGB
+	}
+	return p.ParametersB * p.BytesPerParameter * memoryOverhead
+}
+
+// batchPolicy returns the batching policy of a model
+func (c Config) batchPolicy(modelID string) BatchPolicy {
+	policy := c.Batching.Default
+	if override, ok := c.Batching.Models[modelID]; ok {
+		if override.MaxSize > 0 {
+			policy.MaxSize = override.MaxSize
+		}
+		if override.MaxWait.Duration > 0 {
+			policy.MaxWait = override.MaxWait
+		}
+		if override.MaxTokens > 0 {
+			policy.MaxTokens = override.MaxTokens
+		}
+	}
+	return policy
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// DispatchError is a failure while deciding or assigning the service of a group, answered to the requests it affects
+// with StatusCode while the Dispatcher keeps serving other requests
+type DispatchError struct {
+	StatusCode int
+	Op         string // what failed, ex. "list nodes"
+	Err        error
+}
+
+func (e *DispatchError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+func (e *DispatchError) Unwrap() error {
+	return e.Err
+}
+
+// newDispatchError wraps a failure with the status code answered to the client
+func newDispatchError(statusCode int, op string, err error) *DispatchError {
+	return &DispatchError{StatusCode: statusCode, Op: op, Err: err}
+}
+
+// kubernetesError wraps a failed Kubernetes or Knative API call, mapping it to the status code the client should see:
+// throttled or unreachable API servers are temporary (503), rejected objects are caused by the request (400),
+// anything else is a failure of the cluster behind the Dispatcher (502)
+func kubernetesError(op string, err error) *DispatchError {
+	statusCode := http.StatusBadGateway
+	switch {
+	case apierrors.IsTooManyRequests(err), apierrors.IsServerTimeout(err), apierrors.IsTimeout(err),
+		apierrors.IsServiceUnavailable(err):
+		statusCode = http.StatusServiceUnavailable
+	case apierrors.IsInvalid(err), apierrors.IsBadRequest(err):
+		statusCode = http.StatusBadRequest
+	case apierrors.IsUnauthorized(err), apierrors.IsForbidden(err):
+		statusCode = http.StatusInternalServerError // the Dispatcher's service account lacks permissions
+	case !isAPIStatus(err):
+		statusCode = http.StatusServiceUnavailable // the API server could not be reached
+	}
+	return newDispatchError(statusCode, op, err)
+}
+
+func isAPIStatus(err error) bool {
+	var status apierrors.APIStatus
+	return errors.As(err, &status)
+}
+
+// errorStatus returns the status code answered for an error, 500 for errors that are not a DispatchError
+func errorStatus(err error) int {
+	var dispatchErr *DispatchError
+	if errors.As(err, &dispatchErr) {
+		return dispatchErr.StatusCode
+	}
+	return http.StatusInternalServerError
+}
+
+// failGroup answers every request of a group that could not be dispatched
+func failGroup(group RequestGroup, err error) {
+	log.Printf("Failed to dispatch group of %d requests: %v", len(group.Requests), err)
+	for _, req := range group.Requests {
+		rejectRequest(req, errorStatus(err), err)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultForwardTimeout      = 5 * time.Minute
+	defaultForwardRetries      = 3
+	defaultForwardBackoff      = 200 * time.Millisecond
+	defaultForwardMaxBackoff   = 5 * time.Second
+	defaultBreakerThreshold    = 5
+	defaultBreakerOpenDuration = 30 * time.Second
+)
+
+// errForwardTimeout cancels an attempt that got no response within the timeout of its model
+var errForwardTimeout = errors.New("forward timeout")
+
+// forwardClient sends every forwarded request, timeouts are set per request from the model's policy
+var forwardClient = &http.Client{}
+
+// sendWithRetries posts a payload to a service, retrying failures that happened before the service handled the request:
+// dial errors while a revision switches and 502/503 answered by Kourier or the activator.
+// The returned cancel releases the attempt and must be called once the response body is consumed.
+func sendWithRetries(request Request, url, host string, payload []byte, policy ForwardPolicy) (*http.Response, func(), error) {
+	for attempt := 0; ; attempt++ {
+		ctx, cancelCause := context.WithCancelCause(request.context())
+		timer := time.AfterFunc(policy.Timeout.Duration, func() { cancelCause(errForwardTimeout) })
+		cancel := func() {
+			timer.Stop()
+			cancelCause(context.Canceled)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
+		if err != nil {
+			cancel()
+			return nil, nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Host = host
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := forwardClient.Do(req)
+		if err == nil && request.Stream && resp.StatusCode == http.StatusOK {
+			timer.Stop() // a stream runs as long as the generation once its first byte arrived
+		} else if err == nil {
+			// read the body within the timeout of the attempt
+			body, readErr := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			if readErr != nil {
+				resp, err = nil, fmt.Errorf("failed to read response: %w", readErr)
+			}
+		}
+		if err != nil && errors.Is(context.Cause(ctx), errForwardTimeout) {
+			err = fmt.Errorf("no response within %s: %w", policy.Timeout.Duration, errForwardTimeout)
+		}
+
+		reason := retryReason(resp, err)
+		if reason == "" || attempt >= policy.Retries || request.context().Err() != nil {
+			if err != nil {
+				cancel()
+				return nil, nil, err
+			}
+			return resp, cancel, nil
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		cancel()
+		delay := backoffDelay(policy, attempt)
+		forwardRetries.WithLabelValues(request.metricModel(), reason).Inc()
+		log.Printf("Retrying request %s in %s after %s (attempt %d of %d)", request.ID, delay.Round(time.Millisecond), reason, attempt+1, policy.Retries)
+		select {
+		case <-time.After(delay):
+		case <-request.context().Done():
+			return nil, nil, request.context().Err()
+		}
+	}
+}
+
+// retryReason names a failure that is safe to retry because the service did not handle the request, "" if there is none
+func retryReason(resp *http.Response, err error) string {
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return "dial"
+		}
+		return ""
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return strconv.Itoa(resp.StatusCode)
+	}
+	return ""
+}
+
+// backoffDelay is an exponential backoff with full jitter, so retries of a batch do not hit the service together
+func backoffDelay(policy ForwardPolicy, attempt int) time.Duration {
+	ceiling := policy.Backoff.Duration << attempt
+	if ceiling <= 0 || ceiling > policy.MaxBackoff.Duration {
+		ceiling = policy.MaxBackoff.Duration
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// cancelOnClose releases the attempt of a stream once the handler closes its body
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// CircuitState is the state of the circuit breaker of a service, exported as a metric value
+type CircuitState int
+
+const (
+	CircuitClosed   CircuitState = iota // requests are forwarded
+	CircuitHalfOpen                     // one probe request decides whether the circuit closes again
+	CircuitOpen                         // requests are rejected without reaching the service
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitHalfOpen:
+		return "half-open"
+	case CircuitOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker stops forwarding to a service that keeps failing, giving it time to recover
+type CircuitBreaker struct {
+	mu       sync.Mutex
+	name     string
+	state    CircuitState
+	failures int       // consecutive failed requests
+	openedAt time.Time // when the circuit last opened
+	probing  bool      // a probe request is in flight while half-open
+}
+
+var (
+	circuitBreakers   = make(map[string]*CircuitBreaker) // keyed by route, namespace/name of a service with @tag of a revision
+	circuitBreakersMu sync.Mutex
+)
+
+// breakerFor returns the circuit breaker of a service, creating a closed one if needed
+func breakerFor(name string) *CircuitBreaker {
+	circuitBreakersMu.Lock()
+	defer circuitBreakersMu.Unlock()
+	breaker, ok := circuitBreakers[name]
+	if !ok {
+		breaker = &CircuitBreaker{name: name}
+		circuitBreakers[name] = breaker
+		circuitState.WithLabelValues(name).Set(float64(CircuitClosed))
+	}
+	return breaker
+}
+
+// forgetBreakers drops the circuit breakers, and their metrics, of the routes whose service is not in exists
+func forgetBreakers(exists func(key string) bool) {
+	circuitBreakersMu.Lock()
+	defer circuitBreakersMu.Unlock()
+	for route := range circuitBreakers {
+		key, _, _ := strings.Cut(route, "@")
+		if exists(key) {
+			continue
+		}
+		delete(circuitBreakers, route)
+		circuitState.DeleteLabelValues(route)
+		circuitRejections.DeleteLabelValues(route)
+	}
+}
+
+// allow reports whether a request may be forwarded, and otherwise how long until the service is probed again
+func (b *CircuitBreaker) allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		openDuration := dispatcherConfig.Forwarding.Breaker.OpenDuration.Duration
+		if waited := time.Since(b.openedAt); waited < openDuration {
+			return false, openDuration - waited
+		}
+		b.setState(CircuitHalfOpen)
+		b.probing = true
+		return true, 0
+	case CircuitHalfOpen:
+		if b.probing {
+			return false, dispatcherConfig.Queueing.RetryAfter.Duration
+		}
+		b.probing = true
+		return true, 0
+	}
+	return true, 0
+}
+
+// record counts the outcome of an allowed request
+func (b *CircuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		b.setState(CircuitClosed)
+		return
+	}
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= dispatcherConfig.Forwarding.Breaker.FailureThreshold {
+		b.openedAt = time.Now()
+		b.setState(CircuitOpen)
+	}
+}
+
+// release ends an allowed request that says nothing about the service, ex. the client went away
+func (b *CircuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *CircuitBreaker) setState(state CircuitState) {
+	if b.state == state {
+		return
+	}
+	log.Printf("Circuit of service %s: %s -> %s", b.name, b.state, state)
+	b.state = state
+	circuitState.WithLabelValues(b.name).Set(float64(state))
+}
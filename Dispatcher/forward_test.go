@@ -0,0 +1,154 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cfg := dispatcherConfig.Forwarding.Breaker
+	dispatcherConfig.Forwarding.Breaker = BreakerConfig{FailureThreshold: 3, OpenDuration: metav1.Duration{Duration: time.Minute}}
+	t.Cleanup(func() { dispatcherConfig.Forwarding.Breaker = cfg })
+
+	fail := func(b *CircuitBreaker, n int) {
+		for i := 0; i < n; i++ {
+			b.allow()
+			b.record(true)
+		}
+	}
+	expire := func(b *CircuitBreaker) { b.openedAt = time.Now().Add(-2 * time.Minute) }
+
+	tests := []struct {
+		name        string
+		run         func(b *CircuitBreaker)
+		wantState   CircuitState
+		wantAllowed bool
+	}{
+		{
+			name:        "closed below the threshold",
+			run:         func(b *CircuitBreaker) { fail(b, 2) },
+			wantState:   CircuitClosed,
+			wantAllowed: true,
+		},
+		{
+			name:        "opens at the threshold",
+			run:         func(b *CircuitBreaker) { fail(b, 3) },
+			wantState:   CircuitOpen,
+			wantAllowed: false,
+		},
+		{
+			name: "success resets the consecutive failures",
+			run: func(b *CircuitBreaker) {
+				fail(b, 2)
+				b.allow()
+				b.record(false)
+				fail(b, 2)
+			},
+			wantState:   CircuitClosed,
+			wantAllowed: true,
+		},
+		{
+			name: "half-open lets a single probe through",
+			run: func(b *CircuitBreaker) {
+				fail(b, 3)
+				expire(b)
+				if allowed, _ := b.allow(); !allowed {
+					t.Error("probe not allowed after the open duration")
+				}
+			},
+			wantState:   CircuitHalfOpen,
+			wantAllowed: false,
+		},
+		{
+			name: "successful probe closes",
+			run: func(b *CircuitBreaker) {
+				fail(b, 3)
+				expire(b)
+				b.allow()
+				b.record(false)
+			},
+			wantState:   CircuitClosed,
+			wantAllowed: true,
+		},
+		{
+			name: "failed probe opens again",
+			run: func(b *CircuitBreaker) {
+				fail(b, 3)
+				expire(b)
+				b.allow()
+				b.record(true)
+			},
+			wantState:   CircuitOpen,
+			wantAllowed: false,
+		},
+		{
+			name: "released probe lets the next one through",
+			run: func(b *CircuitBreaker) {
+				fail(b, 3)
+				expire(b)
+				b.allow()
+				b.release()
+			},
+			wantState:   CircuitHalfOpen,
+			wantAllowed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &CircuitBreaker{name: "test"}
+			tt.run(b)
+			if b.state != tt.wantState {
+				t.Errorf("state = %s, want %s", b.state, tt.wantState)
+			}
+			allowed, retryAfter := b.allow()
+			if allowed != tt.wantAllowed {
+				t.Errorf("allow() = %v, want %v", allowed, tt.wantAllowed)
+			}
+			if !allowed && retryAfter <= 0 {
+				t.Errorf("retry after %s for a rejected request", retryAfter)
+			}
+		})
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	policy := ForwardPolicy{
+		Backoff:    metav1.Duration{Duration: 100 * time.Millisecond},
+		MaxBackoff: metav1.Duration{Duration: time.Second},
+	}
+	tests := []struct {
+		attempt     int
+		wantCeiling time.Duration
+	}{
+		{attempt: 0, wantCeiling: 100 * time.Millisecond},
+		{attempt: 1, wantCeiling: 200 * time.Millisecond},
+		{attempt: 3, wantCeiling: 800 * time.Millisecond},
+		{attempt: 4, wantCeiling: time.Second},  // capped
+		{attempt: 70, wantCeiling: time.Second}, // the shift overflows
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if delay := backoffDelay(policy, tt.attempt); delay < 0 || delay > tt.wantCeiling {
+				t.Fatalf("backoffDelay(attempt %d) = %s, want within [0, %s]", tt.attempt, delay, tt.wantCeiling)
+			}
+		}
+	}
+}
+
+func TestForgetBreakers(t *testing.T) {
+	for _, route := range []string{"ns/a", "ns/a@candidate", "ns/ab", "ns/b"} {
+		breakerFor(route)
+	}
+	t.Cleanup(func() { forgetBreakers(func(string) bool { return false }) })
+
+	forgetBreakers(func(key string) bool { return key != "ns/a" }) // ns/a was deleted
+	circuitBreakersMu.Lock()
+	defer circuitBreakersMu.Unlock()
+	for route, want := range map[string]bool{"ns/a": false, "ns/a@candidate": false, "ns/ab": true, "ns/b": true} {
+		if _, ok := circuitBreakers[route]; ok != want {
+			t.Errorf("breaker of %s kept = %v, want %v", route, ok, want)
+		}
+	}
+}
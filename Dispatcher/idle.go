@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/util/retry"
+	"knative.dev/client/pkg/kn/commands"
+	clientservingv1 "knative.dev/client/pkg/serving/v1"
+	"knative.dev/serving/pkg/apis/autoscaling"
+	servingv1 "knative.dev/serving/pkg/apis/serving/v1"
+)
+
+const (
+	managedByLabel         = "app.kubernetes.io/managed-by" // label of the services created by the Dispatcher
+	managedByValue         = "kubecomp-dispatcher"
+	idleActionDelete       = "delete"      // delete idle services, freeing their MIG slices and revisions
+	idleActionScaleToZero  = "scaleToZero" // drop min-scale of idle services to 0, Knative scales them down
+	idleActionNone         = "none"        // keep idle services
+	defaultIdleTTL         = 30 * time.Minute
+	maxIdleCheckInterval   = time.Minute
+	serviceDeletionTimeout = 30 * time.Second            // wait for a deleted service to be gone before it can be created again
+	lastRequestAnnotation  = "kubecomp.com/last-request" // latest request any replica forwarded to the service, RFC 3339
+	scaledDownAnnotation   = "kubecomp.com/scaled-down"  // min-scale was dropped to 0 while idle, it is restored on the next request
+)
+
+// newServingClient returns a Knative serving client of a namespace
+var newServingClient = func(namespace string) (clientservingv1.KnServingClient, error) {
+	p := commands.KnParams{}
+	p.Initialize()
+	return p.NewServingClient(namespace)
+}
+
+var (
+	restoring   = make(map[string]bool) // services whose min-scale is being restored, by namespace/name
+	restoringMu sync.Mutex
+)
+
+// scaleAnnotations adds the min and max scale of a catalog entry to the annotations of a revision template
+func scaleAnnotations(entry CatalogEntry, annotations map[string]string) map[string]string {
+	if entry.MinScale > 0 {
+		annotations[autoscaling.MinScaleAnnotationKey] = strconv.Itoa(entry.MinScale)
+	}
+	if entry.MaxScale > 0 {
+		annotations[autoscaling.MaxScaleAnnotationKey] = strconv.Itoa(entry.MaxScale)
+	}
+	return annotations
+}
+
+// collectIdleServices periodically deletes or scales to zero the Dispatcher's services idle for longer than the idle TTL
+func collectIdleServices() {
+	cfg := dispatcherConfig.Services
+	if cfg.IdleAction == idleActionNone {
+		log.Printf("Idle service collection is disabled")
+		return
+	}
+	ticker := time.NewTicker(idleCheckInterval())
+	defer ticker.Stop()
+	for range ticker.C {
+		pruneRoutes() // every replica forwards, so every replica holds breakers and limiters of deleted services
+		collectIdle(cfg.IdleTTL.Duration, cfg.IdleAction)
+	}
+}
+
+func idleCheckInterval() time.Duration {
+	return min(dispatcherConfig.Services.IdleTTL.Duration/4, maxIdleCheckInterval)
+}
+
+// publishLastRequests periodically records on each service when this replica last forwarded to it
+func publishLastRequests() {
+	if dispatcherConfig.Services.IdleAction == idleActionNone {
+		return
+	}
+	ticker := time.NewTicker(idleCheckInterval())
+	defer ticker.Stop()
+	for range ticker.C {
+		for key, lastRequest := range serviceLifecycle.unpublished() {
+			publishLastRequest(key, lastRequest)
+		}
+	}
+}
+
+func publishLastRequest(key string, lastRequest time.Time) {
+	namespace, name, _ := strings.Cut(key, "/")
+	service, err := clusterCache.Service(namespace, name)
+	if err != nil || service == nil || service.Labels[managedByLabel] != managedByValue {
+		return // only the Dispatcher's services are collected
+	}
+	lastRequest = lastRequest.Truncate(time.Second) // as precise as the annotation
+	if !publishedLastRequest(service).Before(lastRequest) {
+		return // another replica published a later request
+	}
+
+	client, err := newServingClient(namespace)
+	if err != nil {
+		log.Printf("Error creating Knative serving client: %s", err.Error())
+		return
+	}
+	_, err = client.UpdateServiceWithRetry(context.Background(), name, func(service *servingv1.Service) (*servingv1.Service, error) {
+		if !publishedLastRequest(service).Before(lastRequest) {
+			return service, nil
+		}
+		if service.Annotations == nil {
+			service.Annotations = make(map[string]string)
+		}
+		service.Annotations[lastRequestAnnotation] = lastRequest.UTC().Format(time.RFC3339)
+		return service, nil
+	}, 3)
+	if err != nil {
+		log.Printf("Error publishing last request of service %s: %s", key, err.Error())
+	}
+}
+
+// prunedServices are the services seen by the last pruneRoutes, by namespace/name
+var prunedServices map[string]string
+
+// pruneRoutes drops the circuit breakers, in-flight limiters and model metrics of services deleted since, ex. collected
+// as idle by the leader
+func pruneRoutes() {
+	services, err := clusterCache.Services("", labels.Everything())
+	if err != nil {
+		return
+	}
+	existing := make(map[string]string, len(services))
+	names := make(map[string]bool, len(services))
+	for _, service := range services {
+		existing[service.Namespace+"/"+service.Name] = service.Name
+		names[service.Name] = true
+	}
+	exists := func(key string) bool {
+		_, ok := existing[key]
+		return ok
+	}
+	forgetBreakers(exists)
+	forgetLimiters(exists)
+	for key, name := range prunedServices {
+		if _, ok := existing[key]; !ok && !names[name] { // metrics are labelled by name, across namespaces
+			forgetModelMetrics(name)
+		}
+	}
+	prunedServices = existing
+}
+
+// publishedLastRequest reads the last request published on a service, zero if none was
+func publishedLastRequest(service *servingv1.Service) time.Time {
+	published, _ := time.Parse(time.RFC3339, service.Annotations[lastRequestAnnotation])
+	return published
+}
+
+// collectIdle deletes or scales to zero the services idle for longer than ttl. Only the leader collects, the other
+// replicas publish their requests
+func collectIdle(ttl time.Duration, action string) {
+	if !replica.isLeader() {
+		return
+	}
+	services, err := clusterCache.Services("", labels.SelectorFromSet(labels.Set{managedByLabel: managedByValue}))
+	if err != nil {
+		log.Printf("Error listing Knative services: %s", err.Error())
+		return
+	}
+
+	ctx := context.Background()
+
+	for _, service := range services {
+		key := service.Namespace + "/" + service.Name
+		published := publishedLastRequest(service)
+		state, lastRequest := serviceLifecycle.idleSince(key, published)
+		if published.After(lastRequest) {
+			lastRequest = published // forwarded by another replica
+		}
+		idle := time.Since(lastRequest)
+		if state == ServiceCreating || idle < ttl {
+			continue
+		}
+
+		nsClient, err := newServingClient(service.Namespace)
+		if err != nil {
+			log.Printf("Error creating Knative serving client: %s", err.Error())
+			continue
+		}
+		switch action {
+		case idleActionDelete:
+			log.Printf("Deleting service %s, idle for %s", key, idle.Round(time.Second))
+			if err := nsClient.DeleteService(ctx, service.Name, serviceDeletionTimeout); err != nil {
+				log.Printf("Error deleting service %s: %s", key, err.Error())
+				continue
+			}
+			serviceLifecycle.forget(key)
+			exists := func(route string) bool { return route != key }
+			forgetBreakers(exists)
+			forgetLimiters(exists)
+		case idleActionScaleToZero:
+			if service.Annotations[scaledDownAnnotation] == "true" {
+				continue // already scaled down
+			}
+			log.Printf("Scaling service %s to zero, idle for %s", key, idle.Round(time.Second))
+			if err := setMinScale(ctx, nsClient, service.Name, 0); err != nil {
+				log.Printf("Error scaling service %s to zero: %s", key, err.Error())
+			}
+		}
+	}
+}
+
+// restoreMinScale sets the min-scale of the catalog again on a service scaled to zero while idle. Every group sees the
+// service scaled down until the cluster cache catches up, a restore already running for the service is not repeated
+func restoreMinScale(spec ServiceSpec) {
+	entry := modelCatalog.Lookup(spec.ModelID, spec.Variant)
+	if entry.MinScale <= 0 {
+		return
+	}
+	key := spec.key()
+	restoringMu.Lock()
+	if restoring[key] {
+		restoringMu.Unlock()
+		return
+	}
+	restoring[key] = true
+	restoringMu.Unlock()
+	defer func() {
+		restoringMu.Lock()
+		delete(restoring, key)
+		restoringMu.Unlock()
+	}()
+
+	client, err := newServingClient(spec.Namespace)
+	if err != nil {
+		log.Printf("Error creating Knative serving client: %s", err.Error())
+		return
+	}
+	log.Printf("Restoring min-scale %d of service %s", entry.MinScale, key)
+	if err := setMinScale(context.Background(), client, spec.Name, entry.MinScale); err != nil {
+		log.Printf("Error restoring min-scale of service %s: %s", key, err.Error())
+	}
+}
+
+// setMinScale sets the min-scale annotation of the revisions a service routes to, 0 removes it and marks the service
+// scaled down. The revision template is left alone: changing it would roll out a new revision on every toggle, and
+// revisions created later take their min-scale from it. Updates retry on conflicts with the other replicas
+func setMinScale(ctx context.Context, client clientservingv1.KnServingClient, name string, minScale int) error {
+	service, err := client.GetService(ctx, name)
+	if err != nil {
+		return err
+	}
+	if scaledDown := service.Annotations[scaledDownAnnotation] == "true"; scaledDown == (minScale == 0) {
+		return nil // done by another group or replica, the cache was behind
+	}
+	for _, revisionName := range servedRevisions(service) {
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			revision, err := client.GetRevision(ctx, revisionName)
+			if err != nil {
+				return err
+			}
+			if revision.Annotations == nil {
+				revision.Annotations = make(map[string]string)
+			}
+			if minScale > 0 {
+				revision.Annotations[autoscaling.MinScaleAnnotationKey] = strconv.Itoa(minScale)
+			} else {
+				delete(revision.Annotations, autoscaling.MinScaleAnnotationKey)
+			}
+			return client.UpdateRevision(ctx, revision)
+		})
+		if err != nil {
+			return fmt.Errorf("revision %s: %w", revisionName, err)
+		}
+	}
+	// marked last, so a service left half done is toggled again
+	_, err = client.UpdateServiceWithRetry(ctx, name, func(service *servingv1.Service) (*servingv1.Service, error) {
+		if service.Annotations == nil {
+			service.Annotations = make(map[string]string)
+		}
+		if minScale > 0 {
+			delete(service.Annotations, scaledDownAnnotation)
+		} else {
+			service.Annotations[scaledDownAnnotation] = "true"
+		}
+		return service, nil
+	}, 3)
+	return err
+}
+
+// servedRevisions returns the revisions a service routes traffic to, its latest ready revision until its route is set
+func servedRevisions(service *servingv1.Service) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, target := range service.Status.Traffic {
+		if target.RevisionName != "" && !seen[target.RevisionName] {
+			seen[target.RevisionName] = true
+			names = append(names, target.RevisionName)
+		}
+	}
+	if len(names) == 0 && service.Status.LatestReadyRevisionName != "" {
+		names = append(names, service.Status.LatestReadyRevisionName)
+	}
+	return names
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	clientservingv1 "knative.dev/client/pkg/serving/v1"
+	"knative.dev/serving/pkg/apis/autoscaling"
+	servingv1 "knative.dev/serving/pkg/apis/serving/v1"
+	servingfake "knative.dev/serving/pkg/client/clientset/versioned/fake"
+	servinglisters "knative.dev/serving/pkg/client/listers/serving/v1"
+)
+
+// idleService is a service of the Dispatcher kept warm by min-scale, serving one revision, whose last request was published at lastRequest
+func idleService(name string, lastRequest time.Time) (*servingv1.Service, *servingv1.Revision) {
+	service := &servingv1.Service{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "kubecomp",
+		Name:        name,
+		Labels:      map[string]string{managedByLabel: managedByValue},
+		Annotations: map[string]string{lastRequestAnnotation: lastRequest.UTC().Format(time.RFC3339)},
+	}}
+	service.Spec.Template.Annotations = map[string]string{autoscaling.MinScaleAnnotationKey: "1"}
+	service.Status.Traffic = []servingv1.TrafficTarget{{RevisionName: name + "-00001"}}
+	revision := &servingv1.Revision{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "kubecomp",
+		Name:        name + "-00001",
+		Annotations: map[string]string{autoscaling.MinScaleAnnotationKey: "1"},
+	}}
+	return service, revision
+}
+
+// withServingClients serves the services from the cluster cache and the Knative serving clients from a fake clientset
+func withServingClients(t *testing.T, services []*servingv1.Service, revisions []*servingv1.Revision) *servingfake.Clientset {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	clientset := servingfake.NewSimpleClientset()
+	for _, service := range services {
+		indexer.Add(service.DeepCopy())
+		clientset.Tracker().Add(service)
+	}
+	for _, revision := range revisions {
+		clientset.Tracker().Add(revision)
+	}
+	savedCache, savedClient, savedLifecycle := clusterCache, newServingClient, serviceLifecycle
+	clusterCache = &ClusterCache{synced: true, services: servinglisters.NewServiceLister(indexer)}
+	newServingClient = func(namespace string) (clientservingv1.KnServingClient, error) {
+		return clientservingv1.NewKnServingClient(clientset.ServingV1(), namespace), nil
+	}
+	serviceLifecycle = NewServiceLifecycle()
+	t.Cleanup(func() { clusterCache, newServingClient, serviceLifecycle = savedCache, savedClient, savedLifecycle })
+	return clientset
+}
+
+// minScaleState returns the scaled-down annotation of a service, the min-scale of its revision and of its template
+func minScaleState(t *testing.T, clientset *servingfake.Clientset, name string) (scaledDown, revisionMinScale, templateMinScale string) {
+	ctx := context.Background()
+	service, err := clientset.ServingV1().Services("kubecomp").Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("service %s: %v", name, err)
+	}
+	revision, err := clientset.ServingV1().Revisions("kubecomp").Get(ctx, name+"-00001", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("revision of %s: %v", name, err)
+	}
+	return service.Annotations[scaledDownAnnotation], revision.Annotations[autoscaling.MinScaleAnnotationKey],
+		service.Spec.Template.Annotations[autoscaling.MinScaleAnnotationKey]
+}
+
+func TestCollectIdle(t *testing.T) {
+	tests := []struct {
+		name           string
+		leader         bool
+		wantScaledDown map[string]bool // by service
+	}{
+		{"leader scales idle services down", true, map[string]bool{"idle": true, "busy": false}},
+		{"other replicas do not collect", false, map[string]bool{"idle": false, "busy": false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idle, idleRevision := idleService("idle", time.Now().Add(-2*time.Hour))
+			busy, busyRevision := idleService("busy", time.Now())
+			clientset := withServingClients(t, []*servingv1.Service{idle, busy}, []*servingv1.Revision{idleRevision, busyRevision})
+			r := &Replica{}
+			r.leader.Store(tt.leader)
+			withReplica(t, r)
+
+			collectIdle(time.Hour, idleActionScaleToZero)
+
+			for name, wantScaledDown := range tt.wantScaledDown {
+				scaledDown, revisionMinScale, templateMinScale := minScaleState(t, clientset, name)
+				if got := scaledDown == "true"; got != wantScaledDown {
+					t.Errorf("service %s scaled down = %v, want %v", name, got, wantScaledDown)
+				}
+				if wantRevision := map[bool]string{true: "", false: "1"}[wantScaledDown]; revisionMinScale != wantRevision {
+					t.Errorf("service %s revision min-scale = %q, want %q", name, revisionMinScale, wantRevision)
+				}
+				if templateMinScale != "1" {
+					t.Errorf("service %s template min-scale = %q, the template must be left alone", name, templateMinScale)
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreMinScale(t *testing.T) {
+	savedCatalog := modelCatalog
+	modelCatalog = &CatalogStore{catalog: ModelCatalog{Models: map[string]CatalogEntry{"org/warm": {MinScale: 2}}}}
+	t.Cleanup(func() { modelCatalog = savedCatalog })
+
+	service, revision := idleService("warm", time.Now().Add(-2*time.Hour))
+	service.Annotations[scaledDownAnnotation] = "true"
+	delete(revision.Annotations, autoscaling.MinScaleAnnotationKey)
+	clientset := withServingClients(t, []*servingv1.Service{service}, []*servingv1.Revision{revision})
+	spec := ServiceSpec{Namespace: "kubecomp", Name: "warm", ModelID: "org/warm"}
+
+	// a restore is running already, later groups leave it alone
+	restoringMu.Lock()
+	restoring[spec.key()] = true
+	restoringMu.Unlock()
+	restoreMinScale(spec)
+	if scaledDown, revisionMinScale, _ := minScaleState(t, clientset, "warm"); scaledDown != "true" || revisionMinScale != "" {
+		t.Errorf("restored while another restore runs: scaled down %q, revision min-scale %q", scaledDown, revisionMinScale)
+	}
+	restoringMu.Lock()
+	delete(restoring, spec.key())
+	restoringMu.Unlock()
+
+	restoreMinScale(spec)
+	scaledDown, revisionMinScale, templateMinScale := minScaleState(t, clientset, "warm")
+	if scaledDown != "" || revisionMinScale != "2" {
+		t.Errorf("after restore: scaled down %q, revision min-scale %q, want not scaled down with min-scale 2", scaledDown, revisionMinScale)
+	}
+	if templateMinScale != "1" {
+		t.Errorf("template min-scale = %q, the template must be left alone", templateMinScale)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const defaultMaxInFlight = 32 // requests forwarded to one service at the same time, TGI batches them continuously
+
+// InFlightLimiter bounds the requests forwarded to a service at the same time. Requests waiting for a free
+// slot are let through most urgent priority class first, then in arrival order, so a saturated service
+// serves critical requests before bulk ones
+type InFlightLimiter struct {
+	mu      sync.Mutex
+	running int
+	waiting []*inFlightWaiter
+	next    uint64 // arrival order of the waiters
+}
+
+// inFlightWaiter is a request waiting for a slot, ready is closed once the slot is granted
+type inFlightWaiter struct {
+	priority int
+	seq      uint64
+	ready    chan struct{}
+}
+
+var (
+	inFlightLimiters   = make(map[string]*InFlightLimiter) // keyed by route, like the circuit breakers
+	inFlightLimitersMu sync.Mutex
+)
+
+// limiterFor returns the in-flight limiter of a service, creating it if needed
+func limiterFor(name string) *InFlightLimiter {
+	inFlightLimitersMu.Lock()
+	defer inFlightLimitersMu.Unlock()
+	limiter, ok := inFlightLimiters[name]
+	if !ok {
+		limiter = &InFlightLimiter{}
+		inFlightLimiters[name] = limiter
+	}
+	return limiter
+}
+
+// forgetLimiters drops the in-flight limiters of the routes whose service is not in exists, forwards
+// holding a slot of a dropped limiter release it as usual
+func forgetLimiters(exists func(key string) bool) {
+	inFlightLimitersMu.Lock()
+	defer inFlightLimitersMu.Unlock()
+	for route := range inFlightLimiters {
+		if key, _, _ := strings.Cut(route, "@"); !exists(key) {
+			delete(inFlightLimiters, route)
+		}
+	}
+}
+
+// acquire waits for a slot, at most limit requests hold one at the same time. It fails when ctx is done first
+func (l *InFlightLimiter) acquire(ctx context.Context, priority, limit int) error {
+	l.mu.Lock()
+	if l.running < limit && len(l.waiting) == 0 {
+		l.running++
+		l.mu.Unlock()
+		return nil
+	}
+	waiter := &inFlightWaiter{priority: priority, seq: l.next, ready: make(chan struct{})}
+	l.next++
+	l.waiting = append(l.waiting, waiter)
+	sort.Slice(l.waiting, func(i, j int) bool {
+		if l.waiting[i].priority != l.waiting[j].priority {
+			return l.waiting[i].priority < l.waiting[j].priority
+		}
+		return l.waiting[i].seq < l.waiting[j].seq
+	})
+	l.grant(limit)
+	l.mu.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		select {
+		case <-waiter.ready:
+			l.running-- // granted meanwhile, hand the slot on
+		default:
+			for i, w := range l.waiting {
+				if w == waiter {
+					l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+					break
+				}
+			}
+		}
+		l.grant(limit)
+		return ctx.Err()
+	}
+}
+
+// release frees the slot of a forwarded request and grants it to the next waiter
+func (l *InFlightLimiter) release(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running--
+	l.grant(limit)
+}
+
+// grant hands the free slots to the first waiters, l.mu must be held
+func (l *InFlightLimiter) grant(limit int) {
+	for l.running < limit && len(l.waiting) > 0 {
+		close(l.waiting[0].ready)
+		l.waiting = l.waiting[1:]
+		l.running++
+	}
+}
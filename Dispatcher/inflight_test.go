@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestInFlightLimiter(t *testing.T) {
+	limiter := &InFlightLimiter{}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := limiter.acquire(ctx, 1, 2); err != nil {
+			t.Fatalf("acquire() within the limit = %v", err)
+		}
+	}
+
+	// the limit is reached, waiters are let through most urgent first, then in arrival order
+	granted := make(chan string, 3)
+	wait := func(name string, priority int) {
+		go func() {
+			if err := limiter.acquire(ctx, priority, 2); err == nil {
+				granted <- name
+			}
+		}()
+		time.Sleep(10 * time.Millisecond) // queue the waiters in order
+	}
+	wait("bulk", 2)
+	wait("normal", 1)
+	wait("critical", 0)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := limiter.acquire(cancelled, 0, 2); !errors.Is(err, context.Canceled) {
+		t.Errorf("acquire() of a cancelled request = %v, want %v", err, context.Canceled)
+	}
+
+	for _, want := range []string{"critical", "normal", "bulk"} {
+		select {
+		case name := <-granted:
+			t.Fatalf("%s granted before a slot was released", name)
+		default:
+		}
+		limiter.release(2)
+		select {
+		case name := <-granted:
+			if name != want {
+				t.Errorf("granted %s, want %s", name, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s not granted after a release", want)
+		}
+	}
+	if limiter.running != 2 || len(limiter.waiting) != 0 {
+		t.Errorf("running = %d with %d waiting, want 2 with none", limiter.running, len(limiter.waiting))
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"text/template"
+
+	servingv1 "knative.dev/serving/pkg/apis/serving/v1"
+)
+
+const (
+	ingressModeGateway  = "gateway" // send to the ingress gateway with the Host of the service
+	ingressModeAddress  = "address" // send to the cluster-local address of the service, skipping the gateway
+	defaultGatewayURL   = "http://kourier-internal.kourier-system.svc.cluster.local"
+	defaultHostTemplate = "{{.Name}}.{{.Namespace}}.127.0.0.1.nip.io"
+	defaultNamespace    = "default"
+)
+
+// ServiceTarget is where the requests of a service are sent
+type ServiceTarget struct {
+	Name      string
+	Namespace string
+	Tag       string // traffic tag of the revision the requests go to, empty for the service's traffic split
+	URL       string // base url, the TGI endpoint is appended
+	Host      string // Host header routing the request at the gateway, empty to use the host of URL
+}
+
+func (t ServiceTarget) key() string {
+	return t.Namespace + "/" + t.Name
+}
+
+// route identifies the revisions behind the target, a failing tagged revision does not open the circuit of the service
+func (t ServiceTarget) route() string {
+	if t.Tag == "" {
+		return t.key()
+	}
+	return t.key() + "@" + t.Tag
+}
+
+var hostTemplate = parseHostTemplate(dispatcherConfig.Ingress.HostTemplate)
+
+// parseHostTemplate parses the configured host template, falling back to the default on errors
+func parseHostTemplate(text string) *template.Template {
+	tmpl, err := template.New("host").Option("missingkey=error").Parse(text)
+	if err != nil {
+		log.Printf("Invalid ingress host template %q: %v, use %q", text, err, defaultHostTemplate)
+		return template.Must(template.New("host").Parse(defaultHostTemplate))
+	}
+	return tmpl
+}
+
+// serviceTarget returns where to send the requests of a ready service, or of one of its tagged revisions.
+// In address mode the service's status.address.url is used, services without an address yet are reached
+// through the gateway. Tagged revisions are reached at <tag>-<name>, Knative's default tag template.
+func serviceTarget(spec ServiceSpec, service *servingv1.Service, revision string) (ServiceTarget, error) {
+	target := ServiceTarget{Name: spec.Name, Namespace: spec.Namespace}
+	hostName := spec.Name
+	if revision != "" {
+		tag, err := revisionTag(service, revision)
+		if err != nil {
+			return ServiceTarget{}, err
+		}
+		target.Tag = tag
+		hostName = tag + "-" + spec.Name
+	}
+	if dispatcherConfig.Ingress.Mode == ingressModeAddress {
+		if service != nil && service.Status.Address != nil && service.Status.Address.URL != nil {
+			address := *service.Status.Address.URL
+			if target.Tag != "" {
+				address.Host = target.Tag + "-" + address.Host
+			}
+			target.URL = strings.TrimSuffix(address.String(), "/")
+			return target, nil
+		}
+		log.Printf("Service %s has no address yet, forwarding through the gateway", target.key())
+	}
+
+	target.URL = strings.TrimSuffix(dispatcherConfig.Ingress.GatewayURL, "/")
+	data := ServiceTarget{Name: hostName, Namespace: spec.Namespace}
+	var host bytes.Buffer
+	if err := hostTemplate.Execute(&host, data); err != nil {
+		log.Printf("Error applying ingress host template: %v, use default host", err)
+		host.Reset()
+		template.Must(template.New("host").Parse(defaultHostTemplate)).Execute(&host, data)
+	}
+	target.Host = host.String()
+	return target, nil
+}
@@ -1,29 +1,46 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
-)
+	"time"
 
-const maxRequestsPerGroup = 1 // Threshold to define how much request forms a group
-const numWorkers = 1          // number of preprocess workers
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
 
 func main() {
 
-	// Start worker goroutines for precprocessing and grouping requests
-	for i := 0; i < numWorkers; i++ {
-		go worker()
-	}
-	// Start a single goroutine for the sequential processing of request groups
-	go sequentialProcessor()
+	// Start listing and watching the nodes, pods, Knative services and revisions dispatch decisions are made from
+	go clusterCache.Start()
+	// Grouping workers are started with the queue of each model, see enqueueRequest
+	// Start a single goroutine flushing groups that waited long enough
+	go batchFlusher()
+	// Start reloading the model catalog when its ConfigMap changes
+	go modelCatalog.Watch(defaultCatalogReloadInterval)
+	// Start competing with the other replicas for the leader Lease, the leader collects idle services
+	go replica.RunLeaderElection()
+	// Start publishing when this replica last forwarded to each service, so the leader sees the requests of every replica
+	go publishLastRequests()
+	// Start collecting services idle for longer than the idle TTL
+	go collectIdleServices()
+	// Start reloading the tenants when their Secret changes
+	go tenantStore.Watch(defaultCatalogReloadInterval)
+	// Groups are processed by the workers of groupPool, one per model and tenant
 
 	// Start a Request Handler
-	http.HandleFunc("/", handleRequest)
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	// Requests carry the API key of a tenant once tenants are configured
+	http.HandleFunc("/", requireTenant(handleRequest))
+	http.HandleFunc("GET /results/{id}", requireTenant(handleResult))
+	http.HandleFunc("POST /v1/chat/completions", requireTenant(handleChatCompletions))
+	http.HandleFunc("POST /v1/completions", requireTenant(handleCompletions))
+	http.Handle("GET /metrics", promhttp.Handler())
+	// Serve until terminated, then drain the requests in flight
+	serve(&http.Server{Addr: ":" + dispatcherPort})
 }
 
-// handleRequest processes incoming HTTP requests and enqueues them to request channel
+// handleRequest processes incoming HTTP requests and enqueues them to the queue of their model
 func handleRequest(w http.ResponseWriter, r *http.Request) {
 	log.Println("Received HTTP request:")
 	// Print the incoming request information
@@ -31,7 +48,8 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Request is nil", http.StatusBadRequest)
 		return
 	}
-	log.Printf("Request Content: %v", r)
+	log.Printf("Request: %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	log.Printf("Headers: %v", redactHeader(r.Header))
 
 	// Parse and enqueue the request
 	request := parseRequest(r)
@@ -40,44 +58,158 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
-	requestChannel <- request
+	if err := enqueueRequest(request); err != nil {
+		if request.async {
+			request.respond(Response{StatusCode: err.StatusCode, Err: err})
+		} else {
+			observeResponse(request, Response{StatusCode: err.StatusCode, Err: err})
+		}
+		writeQueueError(w, err)
+		return
+	}
 
-	// Acknowledge receipt of the request
-	w.WriteHeader(http.StatusAccepted)
-	fmt.Fprintf(w, "Request received for model: %s", request.Model)
+	// Asynchronous requests are acknowledged with the ID to poll the result store with
+	if request.async {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{
+			"id":     request.ID,
+			"model":  request.Model,
+			"state":  string(ResultPending),
+			"result": "/results/" + request.ID,
+		})
+		return
+	}
+
+	// Hold the connection until the service answers or the client goes away
+	select {
+	case resp := <-request.respChan:
+		w.Header().Set("X-Request-ID", request.ID)
+		if resp.Stream != nil {
+			writeStream(w, r, resp)
+		} else {
+			writeResponse(w, resp)
+		}
+	case <-r.Context().Done():
+		log.Printf("Client disconnected before response for model: %s", request.Model)
+	}
 }
 
-// worker processes requests from the requestChannel in parallel, groups them and do preprocessing
-func worker() {
-	preprocessor := Preprocessor{}
-	for req := range requestChannel {
-		model := req.Model
+// writeResponse relays the service response (or forwarding error) to the client
+func writeResponse(w http.ResponseWriter, resp Response) {
+	if resp.Err != nil {
+		log.Printf("Error serving request: %v", resp.Err)
+		statusCode := resp.StatusCode
+		if statusCode == 0 {
+			statusCode = http.StatusBadGateway
+		}
+		if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		http.Error(w, fmt.Sprintf("Failed to serve request: %v", resp.Err), statusCode)
+		return
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(resp.Body)
+}
 
-		mu.Lock()
-		group := getOrCreateRequestGroup(model) // check if there is a forming group of this type of request
-		addRequestToGroup(&group, req)          // add to the forming group
-		modelGroups[model] = group
+// worker processes requests from the queue of a model, groups them and do preprocessing
+func worker(queue *ModelQueue) {
+	for {
+		req, ok := queue.dequeueRequest()
+		if !ok {
+			return
+		}
+		groupRequest(req, queue.batch)
+	}
+}
 
-		if len(group.Requests) >= maxRequestsPerGroup { // check if forming group has enough request to form a complete group
-			delete(modelGroups, model) // pop the group
-			mu.Unlock()
+// groupRequest adds a request to its forming group and dispatches the group once it reaches the size or token limit
+func groupRequest(req Request, policy BatchPolicy) {
+	key := req.groupKey()
 
-			preprocessor.process(&group) //  preprocess the complete group
-			processChannel <- group      // enqueue to prcessChannel for seqential processor
-		} else {
-			mu.Unlock()
+	mu.Lock()
+	group := getOrCreateRequestGroup(key, req.Priority) // check if there is a forming group of this type of request
+	addRequestToGroup(&group, req)                      // add to the forming group
+	modelGroups[key] = group
+
+	// check if forming group has reached a size or token limit to form a complete group
+	reason := ""
+	if len(group.Requests) >= policy.MaxSize {
+		reason = "size"
+	} else if policy.MaxTokens > 0 && group.TokenSum >= policy.MaxTokens {
+		reason = "tokens"
+	}
+	if reason != "" {
+		delete(modelGroups, key) // pop the group
+		mu.Unlock()
+		dispatchGroup(group, reason)
+	} else {
+		mu.Unlock()
+	}
+}
+
+// batchFlusher periodically flushes forming groups whose oldest request has waited longer than the max wait
+func batchFlusher() {
+	ticker := time.NewTicker(dispatcherConfig.Batching.TickInterval.Duration)
+	defer ticker.Stop()
+	for range ticker.C {
+		flushExpired()
+	}
+}
+
+// flushExpired dispatches the forming groups past their max wait, or every forming group while draining
+func flushExpired() {
+	var expired []RequestGroup
+	mu.Lock()
+	for key, group := range modelGroups {
+		policy := dispatcherConfig.batchPolicy(group.Requests[0].modelID())
+		if draining.Load() || time.Since(group.CreatedAt) >= policy.MaxWait.Duration { // flush right away while draining
+			delete(modelGroups, key) // pop the group
+			expired = append(expired, group)
 		}
 	}
+	mu.Unlock()
+
+	for _, group := range expired {
+		dispatchGroup(group, "wait")
+	}
+}
+
+// dispatchGroup preprocesses a complete group and submits it for processing
+func dispatchGroup(group RequestGroup, reason string) {
+	model := group.Requests[0].metricModel()
+	log.Printf("Flushing group of %d requests for model %s (%s limit)", len(group.Requests), group.Requests[0].Model, reason)
+	batchSize.WithLabelValues(model).Observe(float64(len(group.Requests)))
+	batchTokens.WithLabelValues(model).Observe(float64(group.TokenSum))
+	batchFlushes.WithLabelValues(model, reason).Inc()
+
+	preprocessor.process(&group) //  preprocess the complete group
+	if len(group.Requests) == 0 {
+		return // every request was rejected by the preprocessor
+	}
+	groupPool.Submit(group.Requests[0].queueKey(), group) // wait for a slot by priority and fair share, groups of one model and tenant are processed one at a time
 }
 
-// sequentialProcessor handles the Decide and Assign steps sequentially
-func sequentialProcessor() {
+// processGroup handles the Decide and Assign steps of a group
+func processGroup(group RequestGroup) {
 	processor := Processor{}
 	assigner := Assigner{}
-	for group := range processChannel {
-		log.Printf("Processing group sequentially for model: %s", group.Requests[0].Model)
+	dropExpired(&group) // requests may have waited too long behind other groups of the model
+	if len(group.Requests) == 0 {
+		return
+	}
+	log.Printf("Processing group for model: %s", group.Requests[0].Model)
 
-		serviceSpec := processor.DecideService(group) // decide the service spec
-		assigner.AssignService(serviceSpec, group)    // create the service and forward the request
+	serviceSpec, err := processor.DecideService(group) // decide the service spec
+	if err != nil {
+		failGroup(group, err)
+		return
+	}
+	if err := assigner.AssignService(serviceSpec, &group); err != nil { // create the service and forward the request
+		failGroup(group, err)
 	}
 }
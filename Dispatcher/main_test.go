@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBatchFlush(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     BatchPolicy
+		tokens     int           // estimated prompt tokens of each request
+		wait       time.Duration // before the flusher ticks, after the last request
+		requests   int
+		wantSizes  []int // of the dispatched groups
+		wantReason string
+	}{
+		{
+			name:       "max size",
+			policy:     BatchPolicy{MaxSize: 3, MaxWait: metav1.Duration{Duration: time.Hour}},
+			requests:   4,
+			wantSizes:  []int{3},
+			wantReason: "size",
+		},
+		{
+			name:       "max tokens",
+			policy:     BatchPolicy{MaxSize: 10, MaxWait: metav1.Duration{Duration: time.Hour}, MaxTokens: 100},
+			tokens:     40,
+			requests:   4,
+			wantSizes:  []int{3}, // 120 tokens, the fourth request starts a new group
+			wantReason: "tokens",
+		},
+		{
+			name:       "max wait",
+			policy:     BatchPolicy{MaxSize: 10, MaxWait: metav1.Duration{Duration: 10 * time.Millisecond}, MaxTokens: 100},
+			tokens:     10,
+			wait:       20 * time.Millisecond,
+			requests:   2,
+			wantSizes:  []int{2},
+			wantReason: "wait",
+		},
+		{
+			name:     "no limit reached",
+			policy:   BatchPolicy{MaxSize: 10, MaxWait: metav1.Duration{Duration: time.Hour}, MaxTokens: 100},
+			tokens:   10,
+			requests: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dispatched := make(chan RequestGroup, 10)
+			savedGroups, savedPool, savedPreprocessor, savedBatching := modelGroups, groupPool, preprocessor, dispatcherConfig.Batching
+			mu.Lock()
+			modelGroups = make(map[string]RequestGroup)
+			mu.Unlock()
+			groupPool = NewKeyedPool(1, func(group RequestGroup) { dispatched <- group })
+			preprocessor = PreprocessPipeline{}
+			dispatcherConfig.Batching = BatchingConfig{Default: tt.policy}
+			t.Cleanup(func() {
+				mu.Lock()
+				defer mu.Unlock()
+				modelGroups, groupPool, preprocessor, dispatcherConfig.Batching = savedGroups, savedPool, savedPreprocessor, savedBatching
+			})
+
+			model := testRequest("org/batched", "").metricModel()
+			flushes := 0.0
+			if tt.wantReason != "" {
+				flushes = testutil.ToFloat64(batchFlushes.WithLabelValues(model, tt.wantReason))
+			}
+			for i := 0; i < tt.requests; i++ {
+				req := testRequest("org/batched", "prompt")
+				req.TokenSize = tt.tokens
+				groupRequest(req, tt.policy)
+			}
+			time.Sleep(tt.wait)
+			flushExpired()
+
+			var sizes []int
+			for len(sizes) < len(tt.wantSizes) {
+				select {
+				case group := <-dispatched:
+					sizes = append(sizes, len(group.Requests))
+				case <-time.After(time.Second):
+					t.Fatalf("dispatched groups of %v, want %v", sizes, tt.wantSizes)
+				}
+			}
+			select {
+			case group := <-dispatched:
+				t.Errorf("unexpected group of %d requests dispatched", len(group.Requests))
+			case <-time.After(20 * time.Millisecond):
+			}
+			for i, size := range sizes {
+				if size != tt.wantSizes[i] {
+					t.Errorf("group %d has %d requests, want %d", i, size, tt.wantSizes[i])
+				}
+			}
+			if tt.wantReason != "" {
+				if got := testutil.ToFloat64(batchFlushes.WithLabelValues(model, tt.wantReason)) - flushes; got != 1 {
+					t.Errorf("%s flushes = %v, want 1", tt.wantReason, got)
+				}
+			}
+		})
+	}
+}
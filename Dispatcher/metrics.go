@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "KubeComp_dispatcher_requests_total",
+			Help: "Answered requests by the status code sent to the client",
+		},
+		[]string{"model", "code"},
+	)
+	requestLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "KubeComp_dispatcher_request_duration_seconds",
+			Help:    "Time from receiving a request to its response, or to the first event of a stream",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 14),
+		},
+		[]string{"model"},
+	)
+	forwardErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "KubeComp_dispatcher_forward_errors_total",
+			Help: "Forwarded requests answered with an error status by the service, or failed before an answer (502, 504)",
+		},
+		[]string{"model", "code"},
+	)
+	serviceCreations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "KubeComp_dispatcher_service_creations_total",
+			Help: "Service creations by result: created, exists (created concurrently) or failed",
+		},
+		[]string{"model", "result"},
+	)
+	timeToReady = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "KubeComp_dispatcher_service_time_to_ready_seconds",
+			Help:    "Cold start time from creating a service until it is Ready",
+			Buckets: prometheus.ExponentialBuckets(5, 2, 10),
+		},
+		[]string{"model"},
+	)
+	batchSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "KubeComp_dispatcher_batch_size",
+			Help:    "Number of requests in a flushed request group",
+			Buckets: prometheus.LinearBuckets(1, 1, 16),
+		},
+		[]string{"model"},
+	)
+	batchTokens = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "KubeComp_dispatcher_batch_tokens",
+			Help:    "Estimated prompt tokens in a flushed request group",
+			Buckets: prometheus.ExponentialBuckets(16, 2, 12),
+		},
+		[]string{"model"},
+	)
+	batchFlushes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "KubeComp_dispatcher_batch_flush_total",
+			Help: "Flushed request groups by the limit that triggered the flush",
+		},
+		[]string{"model", "reason"},
+	)
+	queueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "KubeComp_dispatcher_queue_depth",
+			Help: "Requests waiting in the queue of a model",
+		},
+		[]string{"model"},
+	)
+	queueRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "KubeComp_dispatcher_queue_rejected_total",
+			Help: "Requests not admitted (full, overloaded) or dropped from a queue (expired, cancelled)",
+		},
+		[]string{"model", "reason"},
+	)
+	groupWait = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "KubeComp_dispatcher_group_wait_seconds",
+			Help:    "Time a complete group waited for a processing slot, by priority class",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		},
+		[]string{"priority"},
+	)
+	forwardRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "KubeComp_dispatcher_forward_retries_total",
+			Help: "Forwarded requests sent again by the failure that triggered the retry (dial, 502, 503)",
+		},
+		[]string{"model", "reason"},
+	)
+	circuitState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "KubeComp_dispatcher_circuit_state",
+			Help: "Circuit breaker state of a service: 0 closed, 1 half-open, 2 open",
+		},
+		[]string{"service"},
+	)
+	circuitRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "KubeComp_dispatcher_circuit_rejected_total",
+			Help: "Requests rejected without forwarding because the circuit of their service was open",
+		},
+		[]string{"service"},
+	)
+)
+
+// otherModel labels the metrics of models without a catalog entry or profile, model ids come from clients
+const otherModel = "other"
+
+// modelMetrics are the metrics labelled by model, their series are deleted with the service of the model
+var modelMetrics = []interface {
+	DeletePartialMatch(labels prometheus.Labels) int
+}{requestsTotal, requestLatency, forwardErrors, serviceCreations, timeToReady, batchSize, batchTokens, batchFlushes,
+	queueRejections, forwardRetries}
+
+func init() {
+	// Register the metrics with Prometheus
+	prometheus.MustRegister(requestsTotal, requestLatency, batchSize, batchTokens, batchFlushes, queueDepth, queueRejections,
+		groupWait, forwardRetries, forwardErrors, circuitState, circuitRejections, serviceCreations, timeToReady)
+}
+
+// observeResponse counts a request answered to its client and its end-to-end latency
+func observeResponse(req Request, resp Response) {
+	statusCode := resp.StatusCode
+	if resp.Err != nil && statusCode == 0 {
+		statusCode = http.StatusBadGateway
+	}
+	requestsTotal.WithLabelValues(req.metricModel(), strconv.Itoa(statusCode)).Inc()
+	if !req.ReceivedAt.IsZero() {
+		requestLatency.WithLabelValues(req.metricModel()).Observe(time.Since(req.ReceivedAt).Seconds())
+	}
+}
+
+// modelLabel is the model label of the metrics of a service: its name for the models the Dispatcher is configured
+// for, otherModel for the others so clients can not add series at will
+func modelLabel(modelID, model string) string {
+	if _, ok := dispatcherConfig.Profiles[modelID]; ok || modelCatalog.Has(modelID) {
+		return model
+	}
+	return otherModel
+}
+
+// forgetModelMetrics deletes the series of a deleted service
+func forgetModelMetrics(model string) {
+	for _, metric := range modelMetrics {
+		metric.DeletePartialMatch(prometheus.Labels{"model": model})
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestModelLabel(t *testing.T) {
+	savedCatalog, savedProfiles := modelCatalog, dispatcherConfig.Profiles
+	modelCatalog = &CatalogStore{catalog: ModelCatalog{Models: map[string]CatalogEntry{"meta-llama/*": {}}}}
+	dispatcherConfig.Profiles = map[string]ModelProfile{"org/profiled": {MemoryGB: 3}}
+	t.Cleanup(func() { modelCatalog, dispatcherConfig.Profiles = savedCatalog, savedProfiles })
+
+	tests := []struct {
+		modelID string
+		want    string
+	}{
+		{modelID: "meta-llama/Meta-Llama-3.1-8B", want: "llama-31-8b"},
+		{modelID: "org/profiled", want: "llama-31-8b"},
+		{modelID: "org/anything-a-client-sends", want: otherModel},
+	}
+	for _, tt := range tests {
+		if got := modelLabel(tt.modelID, "llama-31-8b"); got != tt.want {
+			t.Errorf("modelLabel(%q) = %q, want %q", tt.modelID, got, tt.want)
+		}
+	}
+}
+
+func TestForgetModelMetrics(t *testing.T) {
+	requestsTotal.WithLabelValues("deleted-svc", "200").Inc()
+	requestsTotal.WithLabelValues("kept-svc", "200").Inc()
+	batchFlushes.WithLabelValues("deleted-svc", "size").Inc()
+	t.Cleanup(func() { forgetModelMetrics("kept-svc") })
+
+	forgetModelMetrics("deleted-svc")
+	if got := testutil.ToFloat64(requestsTotal.WithLabelValues("kept-svc", "200")); got != 1 {
+		t.Errorf("series of a running service = %v, want 1", got)
+	}
+	if requestsTotal.DeleteLabelValues("deleted-svc", "200") || batchFlushes.DeleteLabelValues("deleted-svc", "size") {
+		t.Error("series of a deleted service left")
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpenAI-compatible request body for /v1/completions and /v1/chat/completions
+type OpenAIRequest struct {
+	Model         string              `json:"model"`
+	Messages      []OpenAIChatMessage `json:"messages"`    // chat completions only
+	Prompt        interface{}         `json:"prompt"`      // completions only, a string or a list with a single string
+	MaxTokens     *int                `json:"max_tokens"`  // mapped to max_new_tokens
+	Temperature   *float64            `json:"temperature"` // 0 means greedy decoding
+	TopP          *float64            `json:"top_p"`
+	Stop          interface{}         `json:"stop"` // a string or a list of strings
+	Seed          *int                `json:"seed"`
+	Stream        bool                `json:"stream"`
+	StreamOptions *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+}
+
+type OpenAIChatMessage struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content"`
+}
+
+type OpenAIChoice struct {
+	Index        int                `json:"index"`
+	Text         *string            `json:"text,omitempty"`    // completions
+	Message      *OpenAIChatMessage `json:"message,omitempty"` // chat completions
+	Delta        *OpenAIChatMessage `json:"delta,omitempty"`   // streamed chat completions
+	FinishReason *string            `json:"finish_reason"`
+}
+
+type OpenAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type OpenAIResponse struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []OpenAIChoice `json:"choices"`
+	Usage   *OpenAIUsage   `json:"usage,omitempty"`
+}
+
+type OpenAIError struct {
+	Error struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+	} `json:"error"`
+}
+
+// Response bodies returned by TGI
+type tgiDetails struct {
+	FinishReason    string            `json:"finish_reason"`
+	GeneratedTokens int               `json:"generated_tokens"`
+	Prefill         []json.RawMessage `json:"prefill"`
+}
+
+type tgiGenerateResponse struct {
+	GeneratedText string      `json:"generated_text"`
+	Details       *tgiDetails `json:"details"`
+}
+
+type tgiStreamResponse struct {
+	Token struct {
+		Text    string `json:"text"`
+		Special bool   `json:"special"`
+	} `json:"token"`
+	Details *tgiDetails `json:"details"`
+	Error   string      `json:"error"`
+}
+
+type tgiError struct {
+	Error     string `json:"error"`
+	ErrorType string `json:"error_type"`
+}
+
+// handleChatCompletions serves POST /v1/chat/completions
+func handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	handleOpenAI(w, r, true)
+}
+
+// handleCompletions serves POST /v1/completions
+func handleCompletions(w http.ResponseWriter, r *http.Request) {
+	handleOpenAI(w, r, false)
+}
+
+// handleOpenAI maps an OpenAI request onto a Request, dispatches it and maps the TGI response back
+func handleOpenAI(w http.ResponseWriter, r *http.Request, chat bool) {
+	defer r.Body.Close()
+	log.Printf("Received OpenAI request: %s", r.URL.Path)
+	// rejected before prepareRequest, which would store a result nothing ever completes
+	if isAsyncRequest(r) {
+		writeOpenAIError(w, http.StatusBadRequest, "asynchronous requests are not supported on the OpenAI API")
+		return
+	}
+
+	var openaiReq OpenAIRequest
+	if err := json.NewDecoder(r.Body).Decode(&openaiReq); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if openaiReq.Model == "" {
+		writeOpenAIError(w, http.StatusBadRequest, "model is required")
+		return
+	}
+
+	var prompt string
+	if chat {
+		if len(openaiReq.Messages) == 0 {
+			writeOpenAIError(w, http.StatusBadRequest, "messages is required")
+			return
+		}
+		prompt = renderChatPrompt(openaiReq.Messages)
+	} else {
+		var ok bool
+		if prompt, ok = singlePrompt(openaiReq.Prompt); !ok {
+			writeOpenAIError(w, http.StatusBadRequest, "prompt must be a string or a list with a single string")
+			return
+		}
+	}
+
+	request := prepareRequest(r, Request{
+		Token:  prompt,
+		Env:    openAIEnv(openaiReq.Model),
+		Par:    openAIParameters(openaiReq),
+		Label:  map[string]string{},
+		Stream: openaiReq.Stream,
+		chat:   openaiReq.Messages, // nil for completions
+	})
+	if request.Model == "" {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid model")
+		return
+	}
+	if err := enqueueRequest(request); err != nil {
+		observeResponse(request, Response{StatusCode: err.StatusCode, Err: err})
+		if err.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(err.RetryAfter.Seconds()))))
+		}
+		writeOpenAIError(w, err.StatusCode, err.Error())
+		return
+	}
+
+	var resp Response
+	select {
+	case resp = <-request.respChan:
+	case <-r.Context().Done():
+		log.Printf("Client disconnected before response for model: %s", request.Model)
+		return
+	}
+
+	w.Header().Set("X-Request-ID", request.ID)
+	if retryAfter := resp.Header.Get("Retry-After"); resp.Err != nil && retryAfter != "" {
+		w.Header().Set("Retry-After", retryAfter)
+	}
+	switch {
+	case resp.Err != nil && resp.StatusCode != 0:
+		writeOpenAIError(w, resp.StatusCode, resp.Err.Error())
+	case resp.Err != nil:
+		writeOpenAIError(w, http.StatusBadGateway, fmt.Sprintf("failed to serve request: %v", resp.Err))
+	case resp.Stream != nil && chat:
+		writeOpenAIChatStream(w, r, resp, openaiReq, request)
+	case resp.Stream != nil:
+		writeOpenAIStream(w, r, resp, openaiReq, request)
+	case resp.StatusCode != http.StatusOK:
+		var tgiErr tgiError
+		if err := json.Unmarshal(resp.Body, &tgiErr); err != nil || tgiErr.Error == "" {
+			tgiErr.Error = string(resp.Body)
+		}
+		writeOpenAIError(w, resp.StatusCode, tgiErr.Error)
+	case chat:
+		writeOpenAIChatResponse(w, resp, openaiReq, request)
+	default:
+		writeOpenAIResponse(w, resp, openaiReq, request)
+	}
+}
+
+// writeOpenAIResponse converts a TGI generate response into an OpenAI completion object
+func writeOpenAIResponse(w http.ResponseWriter, resp Response, openaiReq OpenAIRequest, request Request) {
+	// the compatibility route answers with a list of generations, generate answers with a single one
+	var generations []tgiGenerateResponse
+	if err := json.Unmarshal(resp.Body, &generations); err != nil {
+		var generation tgiGenerateResponse
+		if err := json.Unmarshal(resp.Body, &generation); err != nil {
+			writeOpenAIError(w, http.StatusBadGateway, fmt.Sprintf("invalid response from service: %v", err))
+			return
+		}
+		generations = []tgiGenerateResponse{generation}
+	}
+	if len(generations) == 0 {
+		writeOpenAIError(w, http.StatusBadGateway, "empty response from service")
+		return
+	}
+	generation := generations[0]
+
+	usage := OpenAIUsage{PromptTokens: estimateTokens(request.Token)}
+	finishReason := "stop"
+	if generation.Details != nil {
+		usage.CompletionTokens = generation.Details.GeneratedTokens
+		if len(generation.Details.Prefill) > 0 {
+			usage.PromptTokens = len(generation.Details.Prefill)
+		}
+		finishReason = openAIFinishReason(generation.Details.FinishReason)
+	} else {
+		usage.CompletionTokens = estimateTokens(generation.GeneratedText)
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+
+	choice := OpenAIChoice{FinishReason: &finishReason, Text: &generation.GeneratedText}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newOpenAIResponse(openaiReq, request, false, false, []OpenAIChoice{choice}, &usage))
+}
+
+// writeOpenAIChatResponse relays the chat completion of the service under the request's id and model
+func writeOpenAIChatResponse(w http.ResponseWriter, resp Response, openaiReq OpenAIRequest, request Request) {
+	var completion OpenAIResponse
+	if err := json.Unmarshal(resp.Body, &completion); err != nil {
+		writeOpenAIError(w, http.StatusBadGateway, fmt.Sprintf("invalid response from service: %v", err))
+		return
+	}
+	if len(completion.Choices) == 0 {
+		writeOpenAIError(w, http.StatusBadGateway, "empty response from service")
+		return
+	}
+	for _, choice := range completion.Choices {
+		if choice.FinishReason != nil {
+			*choice.FinishReason = openAIFinishReason(*choice.FinishReason)
+		}
+	}
+	usage := completion.Usage
+	if usage == nil {
+		usage = &OpenAIUsage{PromptTokens: estimateTokens(request.Token)}
+		for _, choice := range completion.Choices {
+			if choice.Message != nil {
+				usage.CompletionTokens += estimateTokens(choice.Message.Content)
+			}
+		}
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newOpenAIResponse(openaiReq, request, true, false, completion.Choices, usage))
+}
+
+// openAIStream writes the server-sent events of an OpenAI stream
+type openAIStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+// startOpenAIStream writes the headers of an event stream, false if the connection cannot stream
+func startOpenAIStream(w http.ResponseWriter) (openAIStream, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeOpenAIError(w, http.StatusInternalServerError, "streaming unsupported")
+		return openAIStream{}, false
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	return openAIStream{w: w, flusher: flusher}, true
+}
+
+func (s openAIStream) writeEvent(data []byte) error {
+	if _, err := fmt.Fprintf(s.w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s openAIStream) writeChunk(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.writeEvent(data)
+}
+
+// writeOpenAIStream converts TGI stream events into OpenAI completion chunks
+func writeOpenAIStream(w http.ResponseWriter, r *http.Request, resp Response, openaiReq OpenAIRequest, request Request) {
+	defer resp.Stream.Close()
+	stream, ok := startOpenAIStream(w)
+	if !ok {
+		return
+	}
+
+	usage := OpenAIUsage{PromptTokens: estimateTokens(request.Token)}
+	err := readEvents(resp.Stream, func(data []byte) error {
+		var event tgiStreamResponse
+		if err := json.Unmarshal(data, &event); err != nil {
+			return fmt.Errorf("invalid event from service: %v", err)
+		}
+		if event.Error != "" {
+			var openaiErr OpenAIError
+			openaiErr.Error.Message = event.Error
+			openaiErr.Error.Type = "server_error"
+			return stream.writeChunk(openaiErr)
+		}
+
+		usage.CompletionTokens++
+		text := ""
+		if !event.Token.Special {
+			text = event.Token.Text
+		}
+		choice := OpenAIChoice{Text: &text}
+		if event.Details != nil {
+			finishReason := openAIFinishReason(event.Details.FinishReason)
+			choice.FinishReason = &finishReason
+			usage.CompletionTokens = event.Details.GeneratedTokens
+		}
+		return stream.writeChunk(newOpenAIResponse(openaiReq, request, false, true, []OpenAIChoice{choice}, nil))
+	})
+	finishOpenAIStream(r, stream, err, openaiReq, request, false, usage)
+}
+
+// writeOpenAIChatStream relays the chat completion chunks of the service under the request's id and model
+func writeOpenAIChatStream(w http.ResponseWriter, r *http.Request, resp Response, openaiReq OpenAIRequest, request Request) {
+	defer resp.Stream.Close()
+	stream, ok := startOpenAIStream(w)
+	if !ok {
+		return
+	}
+
+	usage := OpenAIUsage{PromptTokens: estimateTokens(request.Token)}
+	err := readEvents(resp.Stream, func(data []byte) error {
+		if string(data) == "[DONE]" {
+			return nil // written once the usage is
+		}
+		var chunk struct {
+			OpenAIResponse
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return fmt.Errorf("invalid event from service: %v", err)
+		}
+		if chunk.Error != "" {
+			var openaiErr OpenAIError
+			openaiErr.Error.Message = chunk.Error
+			openaiErr.Error.Type = "server_error"
+			return stream.writeChunk(openaiErr)
+		}
+
+		for _, choice := range chunk.Choices {
+			if choice.FinishReason != nil {
+				*choice.FinishReason = openAIFinishReason(*choice.FinishReason)
+			}
+			if choice.Delta != nil && choice.Delta.Content != "" {
+				usage.CompletionTokens++ // one token per chunk
+			}
+		}
+		if chunk.Usage != nil {
+			usage = *chunk.Usage
+		}
+		return stream.writeChunk(newOpenAIResponse(openaiReq, request, true, true, chunk.Choices, nil))
+	})
+	finishOpenAIStream(r, stream, err, openaiReq, request, true, usage)
+}
+
+// finishOpenAIStream ends a relayed stream with its usage, if the client asked for it, and [DONE]
+func finishOpenAIStream(r *http.Request, stream openAIStream, err error, openaiReq OpenAIRequest, request Request, chat bool, usage OpenAIUsage) {
+	if err != nil {
+		if r.Context().Err() == nil {
+			log.Printf("Error streaming response: %v", err)
+		}
+		return
+	}
+	if openaiReq.StreamOptions != nil && openaiReq.StreamOptions.IncludeUsage {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+		stream.writeChunk(newOpenAIResponse(openaiReq, request, chat, true, []OpenAIChoice{}, &usage))
+	}
+	stream.writeEvent([]byte("[DONE]"))
+}
+
+func newOpenAIResponse(openaiReq OpenAIRequest, request Request, chat bool, chunk bool, choices []OpenAIChoice, usage *OpenAIUsage) OpenAIResponse {
+	response := OpenAIResponse{
+		ID:      "cmpl-" + request.ID,
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   openaiReq.Model,
+		Choices: choices,
+		Usage:   usage,
+	}
+	if chat {
+		response.ID = "chatcmpl-" + request.ID
+		response.Object = "chat.completion"
+		if chunk {
+			response.Object = "chat.completion.chunk"
+		}
+	}
+	return response
+}
+
+func writeOpenAIError(w http.ResponseWriter, statusCode int, message string) {
+	log.Printf("OpenAI request failed (%d): %s", statusCode, message)
+	var openaiErr OpenAIError
+	openaiErr.Error.Message = message
+	openaiErr.Error.Type = "invalid_request_error"
+	if statusCode >= http.StatusInternalServerError {
+		openaiErr.Error.Type = "server_error"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(openaiErr)
+}
+
+// openAIEnv builds the service env for a model, the HF token comes from the Dispatcher's own environment
+func openAIEnv(model string) map[string]string {
+	env := map[string]string{"MODEL_ID": model}
+	if token := os.Getenv("HF_TOKEN"); token != "" {
+		env["HF_TOKEN"] = token
+	}
+	return env
+}
+
+// openAIParameters maps OpenAI sampling options onto TGI generation parameters
+func openAIParameters(openaiReq OpenAIRequest) map[string]interface{} {
+	par := map[string]interface{}{
+		"details": true, // needed for finish reason and generated token count
+	}
+	if !openaiReq.Stream {
+		par["decoder_input_details"] = true // needed for prompt token count, not supported when streaming
+	}
+	if openaiReq.MaxTokens != nil {
+		par["max_new_tokens"] = *openaiReq.MaxTokens
+	}
+	// TGI requires a strictly positive temperature, 0 means greedy decoding
+	if openaiReq.Temperature != nil && *openaiReq.Temperature > 0 {
+		par["temperature"] = *openaiReq.Temperature
+		par["do_sample"] = true
+	}
+	// TGI requires top_p in (0, 1)
+	if openaiReq.TopP != nil && *openaiReq.TopP > 0 && *openaiReq.TopP < 1 {
+		par["top_p"] = *openaiReq.TopP
+	}
+	if openaiReq.Seed != nil {
+		par["seed"] = *openaiReq.Seed
+	}
+	switch stop := openaiReq.Stop.(type) {
+	case string:
+		par["stop"] = []string{stop}
+	case []interface{}:
+		par["stop"] = stop
+	}
+	return par
+}
+
+// renderChatPrompt flattens chat messages into a single prompt, used to size, validate and deduplicate a chat request.
+// The messages themselves are sent to the chat endpoint of the service, which applies the model's chat template
+func renderChatPrompt(messages []OpenAIChatMessage) string {
+	var b strings.Builder
+	for _, message := range messages {
+		fmt.Fprintf(&b, "%s: %s\n", message.Role, message.Content)
+	}
+	b.WriteString("assistant:")
+	return b.String()
+}
+
+// chatPayload builds the body of a chat request for the chat endpoint of the service, mapping the generation
+// parameters back to their OpenAI names
+func chatPayload(req Request) map[string]interface{} {
+	payload := map[string]interface{}{
+		"model":    "tgi", // the service serves a single model
+		"messages": req.chat,
+		"stream":   req.Stream,
+	}
+	for key, value := range req.Par {
+		switch key {
+		case "max_new_tokens":
+			payload["max_tokens"] = value
+		case "temperature", "top_p", "seed", "stop":
+			payload[key] = value
+		}
+	}
+	return payload
+}
+
+// singlePrompt extracts the prompt of a completions request
+func singlePrompt(prompt interface{}) (string, bool) {
+	switch p := prompt.(type) {
+	case string:
+		return p, true
+	case []interface{}:
+		if len(p) == 1 {
+			s, ok := p[0].(string)
+			return s, ok
+		}
+	}
+	return "", false
+}
+
+func openAIFinishReason(finishReason string) string {
+	if finishReason == "length" {
+		return "length"
+	}
+	return "stop" // eos_token and stop_sequence
+}
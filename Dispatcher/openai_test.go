@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOpenAIParameters(t *testing.T) {
+	intPtr := func(v int) *int { return &v }
+	floatPtr := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		name string
+		req  OpenAIRequest
+		want map[string]interface{}
+	}{
+		{
+			name: "defaults ask for details",
+			req:  OpenAIRequest{},
+			want: map[string]interface{}{"details": true, "decoder_input_details": true},
+		},
+		{
+			name: "sampling options",
+			req:  OpenAIRequest{MaxTokens: intPtr(20), Temperature: floatPtr(0.7), TopP: floatPtr(0.9), Seed: intPtr(1), Stop: "\n"},
+			want: map[string]interface{}{"details": true, "decoder_input_details": true, "max_new_tokens": 20,
+				"temperature": 0.7, "do_sample": true, "top_p": 0.9, "seed": 1, "stop": []string{"\n"}},
+		},
+		{
+			name: "zero temperature is greedy and top_p 1 is dropped",
+			req:  OpenAIRequest{Temperature: floatPtr(0), TopP: floatPtr(1), Stop: []interface{}{"a", "b"}},
+			want: map[string]interface{}{"details": true, "decoder_input_details": true, "stop": []interface{}{"a", "b"}},
+		},
+		{
+			name: "no prompt details when streaming",
+			req:  OpenAIRequest{Stream: true},
+			want: map[string]interface{}{"details": true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := openAIParameters(tt.req); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("openAIParameters() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSinglePrompt(t *testing.T) {
+	if prompt, ok := singlePrompt("hi"); !ok || prompt != "hi" {
+		t.Errorf("singlePrompt(string) = %q, %v", prompt, ok)
+	}
+	if prompt, ok := singlePrompt([]interface{}{"hi"}); !ok || prompt != "hi" {
+		t.Errorf("singlePrompt([string]) = %q, %v", prompt, ok)
+	}
+	for _, prompt := range []interface{}{nil, []interface{}{"a", "b"}, []interface{}{1}, 1.0} {
+		if _, ok := singlePrompt(prompt); ok {
+			t.Errorf("singlePrompt(%v) accepted", prompt)
+		}
+	}
+}
+
+func TestWriteOpenAIResponse(t *testing.T) {
+	request := Request{ID: "abc", Token: "What is Deep Learning?"}
+	tests := []struct {
+		name       string
+		body       string
+		wantText   string
+		wantFinish string
+		wantUsage  OpenAIUsage
+	}{
+		{
+			name:       "completion with details",
+			body:       `{"generated_text": " A field of AI.", "details": {"finish_reason": "length", "generated_tokens": 5, "prefill": [{}, {}, {}]}}`,
+			wantText:   " A field of AI.",
+			wantFinish: "length",
+			wantUsage:  OpenAIUsage{PromptTokens: 3, CompletionTokens: 5, TotalTokens: 8},
+		},
+		{
+			name:       "list of generations",
+			body:       `[{"generated_text": "Hello", "details": {"finish_reason": "eos_token", "generated_tokens": 2}}]`,
+			wantText:   "Hello",
+			wantFinish: "stop",
+			wantUsage: OpenAIUsage{PromptTokens: estimateTokens(request.Token), CompletionTokens: 2,
+				TotalTokens: estimateTokens(request.Token) + 2},
+		},
+		{
+			name:       "usage estimated without details",
+			body:       `{"generated_text": "Deep learning uses neural networks"}`,
+			wantText:   "Deep learning uses neural networks",
+			wantFinish: "stop",
+			wantUsage: OpenAIUsage{PromptTokens: estimateTokens(request.Token), CompletionTokens: estimateTokens("Deep learning uses neural networks"),
+				TotalTokens: estimateTokens(request.Token) + estimateTokens("Deep learning uses neural networks")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeOpenAIResponse(w, Response{StatusCode: 200, Body: []byte(tt.body)}, OpenAIRequest{Model: "org/model"}, request)
+
+			var got OpenAIResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("invalid response %s: %v", w.Body, err)
+			}
+			if got.Model != "org/model" || got.Object != "text_completion" || got.ID != "cmpl-abc" || len(got.Choices) != 1 || got.Usage == nil {
+				t.Fatalf("response = %s", w.Body)
+			}
+			choice := got.Choices[0]
+			if choice.Text == nil || *choice.Text != tt.wantText {
+				t.Errorf("text = %v, want %q", choice.Text, tt.wantText)
+			}
+			if choice.FinishReason == nil || *choice.FinishReason != tt.wantFinish {
+				t.Errorf("finish_reason = %v, want %s", choice.FinishReason, tt.wantFinish)
+			}
+			if *got.Usage != tt.wantUsage {
+				t.Errorf("usage = %+v, want %+v", *got.Usage, tt.wantUsage)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	writeOpenAIResponse(w, Response{StatusCode: 200, Body: []byte("not json")}, OpenAIRequest{}, request)
+	if w.Code != 502 {
+		t.Errorf("invalid service response answered with %d, want 502", w.Code)
+	}
+}
+
+func TestWriteOpenAIChatResponse(t *testing.T) {
+	request := Request{ID: "abc", Token: "user: Hi\nassistant:"}
+	body := `{"id": "", "object": "chat.completion", "model": "tgi", "choices": [{"index": 0,
+		"message": {"role": "assistant", "content": "Hello!"}, "finish_reason": "eos_token"}],
+		"usage": {"prompt_tokens": 12, "completion_tokens": 3, "total_tokens": 15}}`
+
+	w := httptest.NewRecorder()
+	writeOpenAIChatResponse(w, Response{StatusCode: 200, Body: []byte(body)}, OpenAIRequest{Model: "org/model"}, request)
+
+	var got OpenAIResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid response %s: %v", w.Body, err)
+	}
+	if got.ID != "chatcmpl-abc" || got.Object != "chat.completion" || got.Model != "org/model" || len(got.Choices) != 1 {
+		t.Fatalf("response = %s", w.Body)
+	}
+	if message := got.Choices[0].Message; message == nil || message.Role != "assistant" || message.Content != "Hello!" {
+		t.Errorf("message = %+v", message)
+	}
+	if finish := got.Choices[0].FinishReason; finish == nil || *finish != "stop" {
+		t.Errorf("finish_reason = %v, want stop", finish)
+	}
+	if want := (OpenAIUsage{PromptTokens: 12, CompletionTokens: 3, TotalTokens: 15}); got.Usage == nil || *got.Usage != want {
+		t.Errorf("usage = %+v, want the usage of the service %+v", got.Usage, want)
+	}
+}
+
+func TestChatPayload(t *testing.T) {
+	messages := []OpenAIChatMessage{{Role: "system", Content: "Be brief"}, {Role: "user", Content: "Hi"}}
+	maxTokens, temperature := 20, 0.7
+	par := openAIParameters(OpenAIRequest{MaxTokens: &maxTokens, Temperature: &temperature, Stop: "\n"})
+
+	got := chatPayload(Request{Par: par, Stream: true, chat: messages})
+	want := map[string]interface{}{"model": "tgi", "messages": messages, "stream": true,
+		"max_tokens": 20, "temperature": 0.7, "stop": []string{"\n"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("chatPayload() = %v, want %v", got, want)
+	}
+}
+
+// readOpenAIStream parses the chunks of an OpenAI stream, checking that it ends with [DONE]
+func readOpenAIStream(t *testing.T, w *httptest.ResponseRecorder) []OpenAIResponse {
+	if got := w.Header().Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	body := w.Body.String()
+	if !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("stream does not end with [DONE]: %q", body)
+	}
+	var chunks []OpenAIResponse
+	err := readEvents(strings.NewReader(body), func(data []byte) error {
+		if string(data) == "[DONE]" {
+			return nil
+		}
+		var chunk OpenAIResponse
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return err
+		}
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("invalid chunk: %v", err)
+	}
+	return chunks
+}
+
+func TestWriteOpenAIStream(t *testing.T) {
+	events := `data:{"token": {"text": "Hello", "special": false}}
+
+data:{"token": {"text": " world", "special": false}}
+
+data:{"token": {"text": "</s>", "special": true}, "details": {"finish_reason": "eos_token", "generated_tokens": 3}}
+
+`
+	openaiReq := OpenAIRequest{Model: "org/model", Stream: true}
+	openaiReq.StreamOptions = &struct {
+		IncludeUsage bool `json:"include_usage"`
+	}{IncludeUsage: true}
+	request := Request{ID: "abc", Token: "Say hello"}
+
+	w := httptest.NewRecorder()
+	resp := Response{StatusCode: 200, Stream: io.NopCloser(strings.NewReader(events))}
+	writeOpenAIStream(w, httptest.NewRequest("POST", "/v1/completions", nil), resp, openaiReq, request)
+	chunks := readOpenAIStream(t, w)
+
+	// three tokens, usage
+	if len(chunks) != 4 {
+		t.Fatalf("got %d chunks, want 4: %s", len(chunks), w.Body)
+	}
+	var text strings.Builder
+	for _, chunk := range chunks[:3] {
+		if chunk.Object != "text_completion" || chunk.Choices[0].Text == nil {
+			t.Fatalf("chunk = %+v", chunk)
+		}
+		text.WriteString(*chunk.Choices[0].Text)
+	}
+	if text.String() != "Hello world" {
+		t.Errorf("streamed text = %q, special tokens must be skipped", text.String())
+	}
+	if finish := chunks[2].Choices[0].FinishReason; finish == nil || *finish != "stop" {
+		t.Errorf("last token finish_reason = %v, want stop", finish)
+	}
+	want := OpenAIUsage{PromptTokens: estimateTokens(request.Token), CompletionTokens: 3, TotalTokens: estimateTokens(request.Token) + 3}
+	if usage := chunks[3].Usage; usage == nil || *usage != want || len(chunks[3].Choices) != 0 {
+		t.Errorf("usage chunk = %+v, want usage %+v", chunks[3], want)
+	}
+}
+
+func TestWriteOpenAIChatStream(t *testing.T) {
+	events := `data: {"id":"","object":"chat.completion.chunk","model":"tgi","choices":[{"index":0,"delta":{"role":"assistant","content":"Hello"},"finish_reason":null}]}
+
+data: {"id":"","object":"chat.completion.chunk","model":"tgi","choices":[{"index":0,"delta":{"role":"assistant","content":" world"},"finish_reason":"eos_token"}]}
+
+data: [DONE]
+
+`
+	openaiReq := OpenAIRequest{Model: "org/model", Stream: true}
+	openaiReq.StreamOptions = &struct {
+		IncludeUsage bool `json:"include_usage"`
+	}{IncludeUsage: true}
+	request := Request{ID: "abc", Token: "user: Say hello\nassistant:"}
+
+	w := httptest.NewRecorder()
+	resp := Response{StatusCode: 200, Stream: io.NopCloser(strings.NewReader(events))}
+	writeOpenAIChatStream(w, httptest.NewRequest("POST", "/v1/chat/completions", nil), resp, openaiReq, request)
+	chunks := readOpenAIStream(t, w)
+	if strings.Count(w.Body.String(), "[DONE]") != 1 {
+		t.Errorf("[DONE] of the service relayed: %s", w.Body)
+	}
+
+	// two chunks of the service, usage
+	if len(chunks) != 3 {
+		t.Fatalf("got %d chunks, want 3: %s", len(chunks), w.Body)
+	}
+	var text strings.Builder
+	for _, chunk := range chunks[:2] {
+		if chunk.ID != "chatcmpl-abc" || chunk.Object != "chat.completion.chunk" || chunk.Model != "org/model" || chunk.Choices[0].Delta == nil {
+			t.Fatalf("chunk = %+v", chunk)
+		}
+		text.WriteString(chunk.Choices[0].Delta.Content)
+	}
+	if text.String() != "Hello world" {
+		t.Errorf("streamed text = %q", text.String())
+	}
+	if finish := chunks[1].Choices[0].FinishReason; finish == nil || *finish != "stop" {
+		t.Errorf("last chunk finish_reason = %v, want stop", finish)
+	}
+	want := OpenAIUsage{PromptTokens: estimateTokens(request.Token), CompletionTokens: 2, TotalTokens: estimateTokens(request.Token) + 2}
+	if usage := chunks[2].Usage; usage == nil || *usage != want {
+		t.Errorf("usage chunk = %+v, want usage %+v", chunks[2], want)
+	}
+}
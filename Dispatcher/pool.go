@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxConcurrency = 16               // groups processed at the same time across all models
+	keyedWorkerBacklog    = 100              // groups waiting for their turn per model, more are answered with 429
+	defaultAgingInterval  = 30 * time.Second // a waiting group moves up one priority class per interval
+)
+
+// defaultPriorities are the priority classes, most urgent first
+var defaultPriorities = []string{"critical", "normal", "bulk"}
+
+// KeyedPool processes groups with the same key (model and tenant) one at a time and groups with different keys concurrently,
+// so a cold start of one model only delays later groups of that model.
+// When groups wait for a free slot, the most urgent priority class goes first and flows (tenants, or models of
+// anonymous requests) of a class share the slots by weight (weighted fair queuing). Waiting groups age into more
+// urgent classes, so bulk groups are delayed but never starved.
+type KeyedPool struct {
+	mu          sync.Mutex
+	waiting     []*pendingGroup
+	backlog     map[string]int     // waiting groups per key
+	running     map[string]bool    // keys with a group in process
+	free        int                // free slots, bounds the groups processed concurrently
+	virtualTime float64            // start tag of the last group taken, flows becoming active start from here
+	flowFinish  map[string]float64 // finish tag of the last group of each flow
+	handle      func(RequestGroup)
+}
+
+// pendingGroup is a group waiting for a slot with its fair queuing tags
+type pendingGroup struct {
+	key       string
+	group     RequestGroup
+	start     float64 // virtual time the group may start at
+	finish    float64 // virtual time the group is done at if served at the flow's share, the smallest goes first
+	submitted time.Time
+}
+
+var groupPool = NewKeyedPool(dispatcherConfig.Processing.MaxConcurrency, processGroup)
+
+func NewKeyedPool(maxConcurrency int, handle func(RequestGroup)) *KeyedPool {
+	return &KeyedPool{
+		backlog:    make(map[string]int),
+		running:    make(map[string]bool),
+		free:       maxConcurrency,
+		flowFinish: make(map[string]float64),
+		handle:     handle,
+	}
+}
+
+// Submit queues a group for processing, answering its requests with 429 if too many groups of its key wait already
+func (p *KeyedPool) Submit(key string, group RequestGroup) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.backlog[key] >= keyedWorkerBacklog {
+		queueRejections.WithLabelValues(group.Requests[0].metricModel(), "backlog").Add(float64(len(group.Requests)))
+		for _, req := range group.Requests {
+			rejectRequest(req, http.StatusTooManyRequests, fmt.Errorf("too many groups of model %s waiting", key))
+		}
+		return
+	}
+
+	// Weighted fair queuing: a flow's groups are spaced by their cost divided by the flow's weight
+	flow := group.flow()
+	start := max(p.virtualTime, p.flowFinish[flow])
+	finish := start + float64(len(group.Requests))/dispatcherConfig.flowWeight(flow)
+	p.flowFinish[flow] = finish
+
+	p.waiting = append(p.waiting, &pendingGroup{key: key, group: group, start: start, finish: finish, submitted: time.Now()})
+	p.backlog[key]++
+	p.schedule()
+}
+
+// schedule starts the next groups while slots are free, p.mu must be held
+func (p *KeyedPool) schedule() {
+	for p.free > 0 {
+		idx := p.next()
+		if idx < 0 {
+			return
+		}
+		pending := p.waiting[idx]
+		p.waiting = append(p.waiting[:idx], p.waiting[idx+1:]...)
+		p.backlog[pending.key]--
+		if p.backlog[pending.key] == 0 {
+			delete(p.backlog, pending.key)
+		}
+		p.running[pending.key] = true
+		p.free--
+		p.virtualTime = max(p.virtualTime, pending.start)
+		if len(p.waiting) == 0 {
+			p.flowFinish = make(map[string]float64) // idle, forget the history of the flows
+		}
+
+		waited := time.Since(pending.submitted)
+		groupWait.WithLabelValues(dispatcherConfig.priorityName(pending.group.Priority)).Observe(waited.Seconds())
+		go p.run(pending)
+	}
+}
+
+// next returns the index of the waiting group to start, -1 if every waiting group's key is busy
+func (p *KeyedPool) next() int {
+	now := time.Now()
+	best := -1
+	bestPriority := 0
+	for i, pending := range p.waiting {
+		if p.running[pending.key] {
+			continue // groups of one model are processed one at a time
+		}
+		priority := pending.effectivePriority(now)
+		if best < 0 || priority < bestPriority ||
+			(priority == bestPriority && pending.finish < p.waiting[best].finish) {
+			best, bestPriority = i, priority
+		}
+	}
+	return best
+}
+
+// effectivePriority is the priority class of a group, raised by one class per aging interval it waited
+func (g *pendingGroup) effectivePriority(now time.Time) int {
+	aged := int(now.Sub(g.submitted) / dispatcherConfig.Scheduling.AgingInterval.Duration)
+	return max(g.group.Priority-aged, 0)
+}
+
+func (p *KeyedPool) run(pending *pendingGroup) {
+	defer func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		delete(p.running, pending.key)
+		p.free++
+		p.schedule()
+	}()
+	p.handle(pending.group)
+}
+
+// pending counts the requests of the groups waiting for a slot
+func (p *KeyedPool) pending() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	count := 0
+	for _, pending := range p.waiting {
+		count += len(pending.group.Requests)
+	}
+	return count
+}
+
+// drop removes the groups waiting for a slot and returns them, the groups in process are not affected
+func (p *KeyedPool) drop() []RequestGroup {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	groups := make([]RequestGroup, 0, len(p.waiting))
+	for _, pending := range p.waiting {
+		groups = append(groups, pending.group)
+	}
+	p.waiting = nil
+	p.backlog = make(map[string]int)
+	p.flowFinish = make(map[string]float64)
+	return groups
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyedPoolNext(t *testing.T) {
+	aging := dispatcherConfig.Scheduling.AgingInterval.Duration
+	dispatcherConfig.Scheduling.AgingInterval.Duration = 30 * time.Second
+	t.Cleanup(func() { dispatcherConfig.Scheduling.AgingInterval.Duration = aging })
+
+	now := time.Now()
+	waiting := func(key string, priority int, finish float64, waited time.Duration) *pendingGroup {
+		return &pendingGroup{key: key, group: RequestGroup{Priority: priority}, finish: finish, submitted: now.Add(-waited)}
+	}
+
+	tests := []struct {
+		name    string
+		waiting []*pendingGroup
+		running []string
+		want    int
+	}{
+		{
+			name:    "nothing waiting",
+			waiting: nil,
+			want:    -1,
+		},
+		{
+			name:    "more urgent class first",
+			waiting: []*pendingGroup{waiting("a", 2, 1, 0), waiting("b", 0, 5, 0), waiting("c", 1, 2, 0)},
+			want:    1,
+		},
+		{
+			name:    "smallest finish tag within a class",
+			waiting: []*pendingGroup{waiting("a", 1, 3, 0), waiting("b", 1, 2, 0), waiting("c", 1, 4, 0)},
+			want:    1,
+		},
+		{
+			name:    "busy keys are skipped",
+			waiting: []*pendingGroup{waiting("a", 0, 1, 0), waiting("b", 1, 2, 0)},
+			running: []string{"a"},
+			want:    1,
+		},
+		{
+			name:    "every key busy",
+			waiting: []*pendingGroup{waiting("a", 0, 1, 0), waiting("a", 1, 2, 0)},
+			running: []string{"a"},
+			want:    -1,
+		},
+		{
+			name:    "aged group overtakes a more urgent class",
+			waiting: []*pendingGroup{waiting("a", 1, 1, 0), waiting("b", 2, 2, 61*time.Second)},
+			want:    1,
+		},
+		{
+			name:    "aging stops at the most urgent class",
+			waiting: []*pendingGroup{waiting("a", 0, 1, 0), waiting("b", 2, 2, time.Hour)},
+			want:    0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewKeyedPool(1, func(RequestGroup) {})
+			p.waiting = tt.waiting
+			for _, key := range tt.running {
+				p.running[key] = true
+			}
+			if got := p.next(); got != tt.want {
+				t.Errorf("next() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyedPoolFairShare(t *testing.T) {
+	weights := dispatcherConfig.Scheduling.Weights
+	dispatcherConfig.Scheduling.Weights = map[string]float64{"team-a": 2}
+	t.Cleanup(func() { dispatcherConfig.Scheduling.Weights = weights })
+
+	group := func(tenant string, size int) RequestGroup {
+		requests := make([]Request, size)
+		for i := range requests {
+			requests[i].tenant = tenant
+		}
+		return RequestGroup{Requests: requests, CreatedAt: time.Now()}
+	}
+	p := NewKeyedPool(0, func(RequestGroup) {}) // no free slot, every group waits
+	p.Submit("a1", group("team-a", 2))
+	p.Submit("b1", group("team-b", 2))
+	p.Submit("a2", group("team-a", 2))
+	p.Submit("b2", group("team-b", 2))
+
+	// team-a has twice the share of team-b: its groups of 2 requests finish every 1, team-b's every 2
+	want := map[string]float64{"a1": 1, "a2": 2, "b1": 2, "b2": 4}
+	for _, pending := range p.waiting {
+		if pending.finish != want[pending.key] {
+			t.Errorf("finish of %s = %v, want %v", pending.key, pending.finish, want[pending.key])
+		}
+	}
+	if got := p.waiting[p.next()].key; got != "a1" {
+		t.Errorf("next() = %s, want a1", got)
+	}
+}
@@ -1,8 +1,303 @@
 package main
 
-type Preprocessor struct{}
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"text/template"
+	"unicode"
+)
 
-func (p Preprocessor) process(group *RequestGroup) {
-	// example preprocess logic :
+const defaultCharsPerToken = 4.0 // average characters per token of BPE tokenizers on english text
 
+// Preprocessor is a single stage of the preprocessing pipeline, run on every complete group
+type Preprocessor interface {
+	Name() string
+	Process(group *RequestGroup)
+}
+
+// PreprocessorFactory builds a stage from its options in the configuration file
+type PreprocessorFactory func(options json.RawMessage) (Preprocessor, error)
+
+// preprocessorFactories holds the available stages by name, register new stages here (or from an init function)
+var preprocessorFactories = map[string]PreprocessorFactory{
+	"validate": newValidateStage,
+	"template": newTemplateStage,
+	"length":   newLengthStage,
+	"dedup":    newDedupStage,
+}
+
+// defaultPreprocessStages is used when the configuration file defines no stages. validate runs after template and
+// length, so the prompt limit applies to the prompt sent to the service, counted with the configured chars per token
+var defaultPreprocessStages = []StageConfig{
+	{Name: "template"},
+	{Name: "length"},
+	{Name: "validate"},
+	{Name: "dedup"},
+}
+
+// PreprocessPipeline runs an ordered chain of stages on a group
+type PreprocessPipeline struct {
+	stages []Preprocessor
+}
+
+var preprocessor = NewPreprocessPipeline(dispatcherConfig.Preprocessing.Stages)
+
+// NewPreprocessPipeline builds the stages in the configured order, skipping unknown or misconfigured stages
+func NewPreprocessPipeline(stageConfigs []StageConfig) PreprocessPipeline {
+	if len(stageConfigs) == 0 {
+		stageConfigs = defaultPreprocessStages
+	}
+
+	var pipeline PreprocessPipeline
+	for _, stageConfig := range stageConfigs {
+		factory, ok := preprocessorFactories[stageConfig.Name]
+		if !ok {
+			log.Printf("Unknown preprocess stage: %s, skipping", stageConfig.Name)
+			continue
+		}
+		stage, err := factory(stageConfig.Options)
+		if err != nil {
+			log.Printf("Invalid options for preprocess stage %s: %v, skipping", stageConfig.Name, err)
+			continue
+		}
+		pipeline.stages = append(pipeline.stages, stage)
+	}
+	log.Printf("Preprocess stages: %v", pipeline.names())
+	return pipeline
+}
+
+func (p PreprocessPipeline) process(group *RequestGroup) {
+	for _, stage := range p.stages {
+		if len(group.Requests) == 0 {
+			return // every request was rejected
+		}
+		stage.Process(group)
+	}
+}
+
+func (p PreprocessPipeline) names() []string {
+	var names []string
+	for _, stage := range p.stages {
+		names = append(names, stage.Name())
+	}
+	return names
+}
+
+// decodeOptions unmarshals the options of a stage, absent options keep the defaults
+func decodeOptions(options json.RawMessage, v interface{}) error {
+	if len(options) == 0 || string(options) == "null" {
+		return nil
+	}
+	return json.Unmarshal(options, v)
+}
+
+// rejectRequest answers a request with an error instead of forwarding it
+func rejectRequest(req Request, statusCode int, err error) {
+	log.Printf("Rejecting request %s: %v", req.ID, err)
+	req.respond(Response{StatusCode: statusCode, Err: err})
+}
+
+// templateStage applies a per model prompt template, ex. "<|user|>{{.Prompt}}<|assistant|>"
+type templateStage struct {
+	templates map[string]*template.Template
+}
+
+func newTemplateStage(options json.RawMessage) (Preprocessor, error) {
+	var opts struct {
+		Templates map[string]string `json:"templates"` // keyed by MODEL_ID
+	}
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	stage := &templateStage{templates: make(map[string]*template.Template)}
+	for modelID, text := range opts.Templates {
+		tmpl, err := template.New(modelID).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for model %s: %w", modelID, err)
+		}
+		stage.templates[modelID] = tmpl
+	}
+	return stage, nil
+}
+
+func (s *templateStage) Name() string { return "template" }
+
+func (s *templateStage) Process(group *RequestGroup) {
+	for i := range group.Requests {
+		req := &group.Requests[i]
+		tmpl, ok := s.templates[req.modelID()]
+		if !ok || req.chat != nil { // the chat endpoint of the service applies the model's own chat template
+			continue
+		}
+		if strings.TrimSpace(req.Token) == "" {
+			continue // left empty for validate to reject
+		}
+		var prompt bytes.Buffer
+		if err := tmpl.Execute(&prompt, struct{ Prompt, Model string }{req.Token, req.modelID()}); err != nil {
+			log.Printf("Error applying template for model %s: %v", req.modelID(), err)
+			continue
+		}
+		req.Token = prompt.String()
+	}
+}
+
+// lengthStage estimates the prompt tokens of every request with a tokenizer approximation
+type lengthStage struct {
+	charsPerToken float64
+}
+
+func newLengthStage(options json.RawMessage) (Preprocessor, error) {
+	opts := struct {
+		CharsPerToken float64 `json:"charsPerToken"`
+	}{CharsPerToken: defaultCharsPerToken}
+	if err := decodeOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	if opts.CharsPerToken <= 0 {
+		return nil, fmt.Errorf("charsPerToken must be positive")
+	}
+	return &lengthStage{charsPerToken: opts.CharsPerToken}, nil
+}
+
+func (s *lengthStage) Name() string { return "length" }
+
+func (s *lengthStage) Process(group *RequestGroup) {
+	group.TokenSum = 0
+	for i := range group.Requests {
+		group.Requests[i].TokenSize = approximateTokens(group.Requests[i].Token, s.charsPerToken)
+		group.TokenSum += group.Requests[i].TokenSize
+	}
+}
+
+// validateStage rejects requests that the service would refuse or that exceed the configured limits. The prompt tokens
+// are the estimate of the length stage, so it runs after it
+type validateStage struct {
+	MaxPromptTokens int `json:"maxPromptTokens"` // 0 disables the limit
+	MaxNewTokens    int `json:"maxNewTokens"`    // upper bound of the max_new_tokens parameter, 0 disables the limit
+}
+
+func newValidateStage(options json.RawMessage) (Preprocessor, error) {
+	stage := &validateStage{}
+	if err := decodeOptions(options, stage); err != nil {
+		return nil, err
+	}
+	return stage, nil
+}
+
+func (s *validateStage) Name() string { return "validate" }
+
+func (s *validateStage) Process(group *RequestGroup) {
+	var valid []Request
+	for _, req := range group.Requests {
+		if err := s.validate(req); err != nil {
+			rejectRequest(req, http.StatusBadRequest, err)
+			group.TokenSum -= req.TokenSize
+			continue
+		}
+		valid = append(valid, req)
+	}
+	group.Requests = valid
+}
+
+func (s *validateStage) validate(req Request) error {
+	if strings.TrimSpace(req.Token) == "" {
+		return fmt.Errorf("empty prompt")
+	}
+	if s.MaxPromptTokens > 0 && req.TokenSize > s.MaxPromptTokens {
+		return fmt.Errorf("prompt has about %d tokens, more than the limit of %d", req.TokenSize, s.MaxPromptTokens)
+	}
+	if maxNewTokens, ok := req.Par["max_new_tokens"]; ok {
+		value, ok := maxNewTokens.(float64) // json numbers
+		if !ok {
+			if intValue, isInt := maxNewTokens.(int); isInt {
+				value, ok = float64(intValue), true
+			}
+		}
+		if !ok || value < 1 {
+			return fmt.Errorf("max_new_tokens must be a positive integer")
+		}
+		if s.MaxNewTokens > 0 && int(value) > s.MaxNewTokens {
+			return fmt.Errorf("max_new_tokens %d exceeds the limit of %d", int(value), s.MaxNewTokens)
+		}
+	}
+	return nil
+}
+
+// dedupStage forwards identical prompts of a group once and fans the response out to every duplicate. The forwarded
+// request lives as long as any of their clients waits, so a client leaving does not drop the others.
+type dedupStage struct{}
+
+func newDedupStage(options json.RawMessage) (Preprocessor, error) {
+	return &dedupStage{}, nil
+}
+
+func (s *dedupStage) Name() string { return "dedup" }
+
+func (s *dedupStage) Process(group *RequestGroup) {
+	var unique []Request
+	seen := make(map[string]int) // dedup key to index in unique
+	for _, req := range group.Requests {
+		if req.Stream {
+			unique = append(unique, req) // a stream can only be relayed to one client
+			continue
+		}
+		par, _ := json.Marshal(req.Par) // map keys are sorted, so equal parameters give equal keys
+		// tenants never share a response, even of a service they share
+		key := req.tenant + "\x00" + req.modelID() + "\x00" + req.Token + "\x00" + string(par)
+		if req.chat != nil {
+			key += "\x00chat" // answered by another endpoint than a completion of the same prompt
+		}
+		if idx, ok := seen[key]; ok {
+			unique[idx].duplicates = append(unique[idx].duplicates, req)
+			group.TokenSum -= req.TokenSize
+			continue
+		}
+		seen[key] = len(unique)
+		unique = append(unique, req)
+	}
+	for i := range unique {
+		// the response is sent for every waiter, so the request must not depend on its own client only
+		if len(unique[i].duplicates) > 0 {
+			unique[i].ctx = waitersContext(append([]Request{unique[i]}, unique[i].duplicates...))
+		}
+	}
+	if removed := len(group.Requests) - len(unique); removed > 0 {
+		log.Printf("Deduplicated %d identical requests", removed)
+	}
+	group.Requests = unique
+}
+
+// estimateTokens approximates the token count of a text when the service does not report it
+func estimateTokens(text string) int {
+	return approximateTokens(text, defaultCharsPerToken)
+}
+
+// approximateTokens counts tokens like a BPE tokenizer would: long words split into several tokens, punctuation is a token of its own
+func approximateTokens(text string, charsPerToken float64) int {
+	tokens := 0
+	wordLength := 0
+	flushWord := func() {
+		if wordLength > 0 {
+			tokens += int(math.Ceil(float64(wordLength) / charsPerToken))
+			wordLength = 0
+		}
+	}
+	for _, r := range text {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			wordLength++
+		case unicode.IsSpace(r):
+			flushWord()
+		default:
+			flushWord()
+			tokens++
+		}
+	}
+	flushWord()
+	return tokens
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testRequest is a synchronous request of a model, its response is read from respChan
+func testRequest(modelID, prompt string) Request {
+	return Request{
+		ID:       prompt,
+		Model:    modelID,
+		Token:    prompt,
+		Env:      map[string]string{"MODEL_ID": modelID},
+		Par:      map[string]interface{}{},
+		respChan: make(chan Response, 1),
+	}
+}
+
+func TestNewPreprocessPipeline(t *testing.T) {
+	pipeline := NewPreprocessPipeline([]StageConfig{
+		{Name: "dedup"},
+		{Name: "unknown"},
+		{Name: "length", Options: json.RawMessage(`{"charsPerToken": -1}`)}, // invalid, skipped
+		{Name: "validate", Options: json.RawMessage(`{"maxNewTokens": 10}`)},
+	})
+	if got, want := pipeline.names(), []string{"dedup", "validate"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stages = %v, want %v", got, want)
+	}
+	if got := NewPreprocessPipeline(nil).names(); len(got) != len(defaultPreprocessStages) {
+		t.Errorf("default stages = %v", got)
+	}
+}
+
+func TestPreprocessPipeline(t *testing.T) {
+	pipeline := NewPreprocessPipeline([]StageConfig{
+		{Name: "template", Options: json.RawMessage(`{"templates": {"org/chat": "<user>{{.Prompt}}<assistant>"}}`)},
+		{Name: "length", Options: json.RawMessage(`{"charsPerToken": 1}`)},
+		{Name: "validate", Options: json.RawMessage(`{"maxNewTokens": 100, "maxPromptTokens": 25}`)},
+	})
+
+	valid := testRequest("org/chat", "hello")
+	empty := testRequest("org/chat", " ")
+	tooLong := testRequest("org/chat", "hello")
+	tooLong.Par["max_new_tokens"] = 500.0
+	// 10 tokens as sent, 27 once templated and counted with the configured ratio
+	overLimit := testRequest("org/chat", "hello there")
+	chat := testRequest("org/chat", "user: hi\nassistant:")
+	chat.chat = []OpenAIChatMessage{{Role: "user", Content: "hi"}}
+	group := RequestGroup{Requests: []Request{valid, empty, tooLong, overLimit, chat}}
+	pipeline.process(&group)
+
+	if len(group.Requests) != 2 || group.Requests[0].ID != valid.ID || group.Requests[1].ID != chat.ID {
+		t.Fatalf("remaining requests = %+v, want the valid and chat ones", group.Requests)
+	}
+	if got := group.Requests[0].Token; got != "<user>hello<assistant>" {
+		t.Errorf("templated prompt = %q", got)
+	}
+	if got := group.Requests[1].Token; got != chat.Token {
+		t.Errorf("chat prompt templated to %q, the service applies the chat template", got)
+	}
+	if group.TokenSum != group.Requests[0].TokenSize+group.Requests[1].TokenSize || group.Requests[0].TokenSize == 0 {
+		t.Errorf("token sum = %d, token size = %d", group.TokenSum, group.Requests[0].TokenSize)
+	}
+	for _, rejected := range []Request{empty, tooLong, overLimit} {
+		select {
+		case resp := <-rejected.respChan:
+			if resp.StatusCode != http.StatusBadRequest || resp.Err == nil {
+				t.Errorf("rejected request answered with %d: %v", resp.StatusCode, resp.Err)
+			}
+		default:
+			t.Errorf("rejected request %q not answered", rejected.Token)
+		}
+	}
+}
+
+func TestDedupStage(t *testing.T) {
+	a1 := testRequest("org/a", "same")
+	a2 := testRequest("org/a", "same")
+	a3 := testRequest("org/a", "same")
+	a3.Par["max_new_tokens"] = 5.0 // other parameters
+	b := testRequest("org/b", "same")
+	otherTenant := testRequest("org/a", "same")
+	otherTenant.tenant = "team-b"
+	streamed1 := testRequest("org/a", "same")
+	streamed1.Stream = true
+	streamed2 := streamed1
+	streamed2.respChan = make(chan Response, 1)
+	for _, req := range []*Request{&a1, &a2, &a3, &b, &otherTenant, &streamed1, &streamed2} {
+		req.TokenSize = 1
+	}
+
+	group := RequestGroup{Requests: []Request{a1, a2, a3, b, otherTenant, streamed1, streamed2}, TokenSum: 7}
+	stage, _ := newDedupStage(nil)
+	stage.Process(&group)
+
+	if len(group.Requests) != 6 || group.TokenSum != 6 {
+		t.Fatalf("got %d requests with %d tokens, want 6 and 6", len(group.Requests), group.TokenSum)
+	}
+	if len(group.Requests[0].duplicates) != 1 {
+		t.Fatalf("first request has %d duplicates, want 1", len(group.Requests[0].duplicates))
+	}
+
+	// the response of the forwarded request reaches its duplicate
+	group.Requests[0].respond(Response{StatusCode: http.StatusOK, Body: []byte("answer")})
+	for name, req := range map[string]Request{"forwarded": a1, "duplicate": a2} {
+		select {
+		case resp := <-req.respChan:
+			if string(resp.Body) != "answer" {
+				t.Errorf("%s request got %q", name, resp.Body)
+			}
+		default:
+			t.Errorf("%s request not answered", name)
+		}
+	}
+}
+
+func TestWaitersContext(t *testing.T) {
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	first, second, async := testRequest("org/a", "same"), testRequest("org/a", "same"), testRequest("org/a", "same")
+	first.ctx, second.ctx, async.ctx = ctx1, ctx2, context.Background()
+
+	ctx := waitersContext([]Request{first, second})
+	cancel1()
+	select {
+	case <-ctx.Done():
+		t.Fatal("done while a client still waits")
+	case <-time.After(20 * time.Millisecond):
+	}
+	cancel2()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("not done once every client went away")
+	}
+
+	if ctx := waitersContext([]Request{first, async}); ctx.Done() != nil {
+		t.Error("an asynchronous request must keep the group alive")
+	}
+}
@@ -2,26 +2,59 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
 
-	v1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"knative.dev/client/pkg/kn/commands"
+	clientservingv1 "knative.dev/client/pkg/serving/v1"
+	servingv1 "knative.dev/serving/pkg/apis/serving/v1"
 )
 
 type Processor struct{}
 
+const (
+	sloLabel      = "slo"      // request label holding the target mean seconds per output token, as used by the autoscaler
+	priorityLabel = "priority" // request label holding the priority class, overrides the X-Priority header
+)
+
+var migConfigList = []string{
+	"nvidia.com/mig-1g.5gb",
+	"nvidia.com/mig-2g.10gb",
+	"nvidia.com/mig-3g.20gb",
+	"nvidia.com/mig-4g.20gb",
+	"nvidia.com/mig-7g.40gb",
+}
+
+var sliceMemoryPattern = regexp.MustCompile(`\.(\d+)gb$`)
+
 type ServiceSpec struct {
 	CPU        int
 	GPU_slices map[string]int
 	Memory     int
 	Env        map[string]string
 	Name       string
+	Namespace  string // namespace the service runs in
+	Tenant     string // tenant owning the service, empty for anonymous requests
+	Secret     string // Secret of the tenant the SecretKeys env is read from
+	SecretKeys []string
 	Model      string
+	ModelID    string // hugging face model id, used to look up the model catalog
+	Variant    string // variant of the model, ex. awq, empty for the model itself
 	Label      map[string]string
 }
 
+// key identifies the service across namespaces
+func (s ServiceSpec) key() string {
+	return s.Namespace + "/" + s.Name
+}
+
 type ResourceEstimate struct {
 	CPU        int
 	GPU_slices map[string]int
@@ -29,88 +62,245 @@ type ResourceEstimate struct {
 }
 
 // DecideService fills the remaining information in the ServiceSpec based on the RequestGroup and ResourceEstimate
-func (d Processor) DecideService(group RequestGroup) ServiceSpec {
+func (d Processor) DecideService(group RequestGroup) (ServiceSpec, error) {
 	log.Println("Deciding service spec based on request group")
-	resourceEstimate := d.ResourceEstimate(group)
-
 	spec := ServiceSpec{
-		CPU:        resourceEstimate.CPU,
-		GPU_slices: resourceEstimate.GPU_slices,
-		Memory:     resourceEstimate.Memory,
-		Env:        group.Requests[0].Env,
-		Name:       group.Requests[0].Model,
-		Model:      group.Requests[0].Model,
-		Label:      group.Requests[0].Label,
+		Env:       group.Requests[0].Env,
+		Name:      group.Requests[0].Model,
+		Namespace: dispatcherConfig.serviceNamespace(group.Requests[0].modelID()),
+		Model:     group.Requests[0].Model,
+		ModelID:   group.Requests[0].modelID(),
+		Variant:   group.Requests[0].Variant,
+		Label:     group.Requests[0].Label,
 	}
-	//log.Printf("Decided ServiceSpec - CPU: %d, GPU: %d, Memory: %d, ServiceName: %s, Model: %s, SLO: %d", spec.CPU, spec.GPU, spec.Memory, spec.ServiceName, spec.Model, spec.SLO)
-	return spec
-}
 
-// Estimate Resource usage for a RequestGroup
-func (d Processor) ResourceEstimate(group RequestGroup) ResourceEstimate {
-	// Policy , gives smallest slice availablem on cluster.
-	log.Println("Estimating resources for request group")
+	// Services of a tenant run in its namespace and hold at most its GPU quota
+	tenant := tenantStore.Get(group.Requests[0].tenant)
+	if tenant != nil {
+		spec.Tenant = tenant.Name
+		if tenant.Namespace != "" {
+			spec.Namespace = tenant.Namespace
+		}
+		if tenant.Secret != "" {
+			spec.Secret, spec.SecretKeys = tenant.Secret, tenant.SecretKeys
+		}
+	}
 
-	var totalCPU int
-	var totalMemory int
-	var migConfigMap = map[string]int{
-		"nvidia.com/mig-1g.5gb":  0,
-		"nvidia.com/mig-2g.10gb": 0,
-		"nvidia.com/mig-3g.20gb": 0,
-		"nvidia.com/mig-4g.20gb": 0,
-		"nvidia.com/mig-7g.40gb": 0,
+	// An existing service keeps the slices it holds, only a new service needs free capacity
+	existing, err := clusterCache.Service(spec.Namespace, spec.Name)
+	if err != nil {
+		return ServiceSpec{}, err
+	}
+	if existing != nil {
+		entry := modelCatalog.Lookup(spec.ModelID, spec.Variant)
+		spec.CPU, spec.Memory, spec.GPU_slices = entry.CPU, entry.Memory, serviceSlices(existing)
+		log.Printf("Service %s exists, keeping its MIG slices %v", spec.key(), spec.GPU_slices)
+		return spec, nil
 	}
 
-	var migConfigList = []string{
-		"nvidia.com/mig-1g.5gb",
-		"nvidia.com/mig-2g.10gb",
-		"nvidia.com/mig-3g.20gb",
-		"nvidia.com/mig-4g.20gb",
-		"nvidia.com/mig-7g.40gb",
+	quota, err := d.remainingQuota(tenant, spec)
+	if err != nil {
+		return ServiceSpec{}, err
 	}
-	//CPU, Memory logic define here
-	totalCPU = 10000     // 10 CPUs, TGI requires massive ammount of cpu and memory , or else there will be error occured
-	totalMemory = 102400 // 100GB , TGI requires massive ammount of cpu and memory , or else there will be error occured
 
-	// GPU logic define here //
-	config, err := rest.InClusterConfig()
+	resourceEstimate, err := d.ResourceEstimate(group, quota)
 	if err != nil {
-		log.Fatalf("Failed to create in-cluster config: %v", err)
+		return ServiceSpec{}, err
 	}
+	spec.CPU = resourceEstimate.CPU
+	spec.GPU_slices = resourceEstimate.GPU_slices
+	spec.Memory = resourceEstimate.Memory
+	//log.Printf("Decided ServiceSpec - CPU: %d, GPU: %d, Memory: %d, ServiceName: %s, Model: %s, SLO: %d", spec.CPU, spec.GPU, spec.Memory, spec.ServiceName, spec.Model, spec.SLO)
+	return spec, nil
+}
 
-	clientset, err := kubernetes.NewForConfig(config)
+// remainingQuota returns the MIG slices per profile a tenant may still take for a new service, nil if it is not limited
+func (d Processor) remainingQuota(tenant *Tenant, spec ServiceSpec) (map[string]int, error) {
+	if tenant == nil || len(tenant.GPUQuota) == 0 {
+		return nil, nil
+	}
+	// services.namespaces may place the models of a tenant in several namespaces, the quota counts them all
+	services, err := clusterCache.Services("", labels.SelectorFromSet(labels.Set{tenantLabel: tenant.Name}))
 	if err != nil {
-		log.Fatalf("Failed to create clientset: %v", err)
+		return nil, err
+	}
+
+	remaining := make(map[string]int)
+	for migConfig, quota := range tenant.GPUQuota {
+		remaining[migConfig] = quota
+	}
+	for _, service := range services {
+		for migConfig, count := range serviceSlices(service) {
+			remaining[migConfig] -= count
+		}
 	}
+	log.Printf("Remaining GPU quota of tenant %s: %v", tenant.Name, remaining)
+	return remaining, nil
+}
 
-	nodes, err := clientset.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{})
+// checkCreatedWithinQuota re-counts the services of a tenant on the API server once one was created, since groups
+// processed concurrently, or by other replicas, may have passed the same remaining quota of a lagging cache.
+// A service taking the tenant over its quota is deleted again and answered with 429.
+func checkCreatedWithinQuota(ctx context.Context, client clientservingv1.KnServingClient, spec ServiceSpec) error {
+	tenant := tenantStore.Get(spec.Tenant)
+	if tenant == nil || len(tenant.GPUQuota) == 0 {
+		return nil
+	}
+	p := commands.KnParams{}
+	p.Initialize()
+	allNamespaces, err := p.NewServingClient("") // the services of a tenant may be in several namespaces
 	if err != nil {
-		log.Fatalf("Failed to list nodes: %v", err)
+		log.Printf("Error re-counting the GPU quota of tenant %s, keeping service %s: %v", tenant.Name, spec.Name, err)
+		return nil
+	}
+	services, err := allNamespaces.ListServices(ctx, clientservingv1.WithLabel(tenantLabel, tenant.Name))
+	if err != nil {
+		log.Printf("Error re-counting the GPU quota of tenant %s, keeping service %s: %v", tenant.Name, spec.Name, err)
+		return nil
+	}
+	if !exceedsQuota(services.Items, tenant.GPUQuota, spec.Namespace, spec.Name) {
+		return nil
 	}
+	log.Printf("Service %s takes tenant %s over its GPU quota, deleting it", spec.key(), tenant.Name)
+	if err := client.DeleteService(ctx, spec.Name, serviceDeletionTimeout); err != nil {
+		log.Printf("Error deleting service %s over quota: %v", spec.key(), err)
+	}
+	return newDispatchError(http.StatusTooManyRequests, "create service", fmt.Errorf("GPU quota of tenant %s is used up", tenant.Name))
+}
 
-	for _, node := range nodes.Items {
-		for _, migConfig := range migConfigList {
-			if Quantity, ok := node.Status.Capacity[v1.ResourceName(migConfig)]; ok {
-				migConfigMap[migConfig] += int(Quantity.Value())
+// exceedsQuota reports whether a service is among the services of a tenant that do not fit its quota. Services are
+// counted oldest first, so every replica agrees that the ones created last are over quota.
+func exceedsQuota(services []servingv1.Service, quota map[string]int, namespace, name string) bool {
+	sort.Slice(services, func(i, j int) bool {
+		if created, other := services[i].CreationTimestamp, services[j].CreationTimestamp; !created.Equal(&other) {
+			return created.Before(&other)
+		}
+		return services[i].Namespace+"/"+services[i].Name < services[j].Namespace+"/"+services[j].Name
+	})
+	used := make(map[string]int)
+	for i := range services {
+		if services[i].DeletionTimestamp != nil {
+			continue // releasing its slices
+		}
+		created := services[i].Namespace == namespace && services[i].Name == name
+		for migConfig, count := range serviceSlices(&services[i]) {
+			used[migConfig] += count
+			if created && used[migConfig] > quota[migConfig] {
+				return true
 			}
 		}
+		if created {
+			return false
+		}
 	}
-	log.Printf("Available MIG slices: %v", migConfigMap)
+	return false
+}
 
-	// Find the smallest available GPU slice
-	smallestSlice := ""
+// Estimate Resource usage for a RequestGroup, taking only slices within quota unless it is nil
+func (d Processor) ResourceEstimate(group RequestGroup, quota map[string]int) (ResourceEstimate, error) {
+	// Policy , gives the smallest slice available on cluster that fits the model weights and meets the group's SLO.
+	log.Println("Estimating resources for request group")
 
-	for _, migConfig := range migConfigList {
-		if migConfigMap[migConfig] > 0 {
-			smallestSlice = migConfig
-			break
+	var totalCPU int
+	var totalMemory int
+
+	modelID := group.Requests[0].modelID()
+	profile := dispatcherConfig.modelProfile(modelID, group.Requests[0].Variant)
+	entry := modelCatalog.Lookup(modelID, group.Requests[0].Variant)
+
+	//CPU, Memory logic define here
+	totalCPU = entry.CPU       // TGI requires massive ammount of cpu and memory , or else there will be error occured
+	totalMemory = entry.Memory // TGI requires massive ammount of cpu and memory , or else there will be error occured
+
+	// GPU logic define here //
+	nodes, err := clusterCache.Nodes()
+	if err != nil {
+		return ResourceEstimate{}, err
+	}
+	pods, err := clusterCache.Pods()
+	if err != nil {
+		return ResourceEstimate{}, err
+	}
+
+	// Without a size the smallest slice would be taken, which may not even load the model
+	if profile.footprintGB() <= 0 && entry.MinProfile == "" {
+		return ResourceEstimate{}, newDispatchError(http.StatusBadRequest, "select MIG slice",
+			fmt.Errorf("size of model %s is unknown, set its profile in the Dispatcher config or a minProfile in the model catalog", modelID))
+	}
+
+	capacity := sliceCapacity(nodes, pods)
+	log.Printf("Free MIG slices: %v, reconfigurable: %v", capacity.Free, capacity.Reconfigurable)
+	selectedSlice, reconfigure := chooseSlice(capacity, profile, entry.MinProfile, group.MinSLO)
+	if selectedSlice == "" {
+		return ResourceEstimate{}, newDispatchError(http.StatusServiceUnavailable, "select MIG slice", fmt.Errorf("no available MIG slice holds model %s (%.1f GB)", modelID, profile.footprintGB()))
+	}
+	if quota != nil {
+		capacity.limit(quota)
+		if selectedSlice, reconfigure = chooseSlice(capacity, profile, entry.MinProfile, group.MinSLO); selectedSlice == "" {
+			// a slice fits, but not within the quota
+			return ResourceEstimate{}, newDispatchError(http.StatusTooManyRequests, "select MIG slice", fmt.Errorf("GPU quota of tenant %s is used up", group.Requests[0].tenant))
 		}
 	}
-	log.Print("Assigned resources , CPU : ", totalCPU, " Memory : ", totalMemory, " GPU : ", smallestSlice)
+	log.Print("Assigned resources , CPU : ", totalCPU, " Memory : ", totalMemory, " GPU : ", selectedSlice, " reconfigure : ", reconfigure)
 
 	return ResourceEstimate{
 		CPU:        totalCPU,                         // Total CPU estimate
-		GPU_slices: map[string]int{smallestSlice: 1}, // Set to 0 for now, unless GPU resources are also required
+		GPU_slices: map[string]int{selectedSlice: 1}, // One slice of the selected MIG profile
 		Memory:     totalMemory,                      // Total Memory estimate
+	}, nil
+}
+
+// newClientset creates a Kubernetes client from the in-cluster config
+func newClientset() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, newDispatchError(http.StatusInternalServerError, "create in-cluster config", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, newDispatchError(http.StatusInternalServerError, "create clientset", err)
+	}
+	return clientset, nil
+}
+
+// selectSlice picks the smallest available slice, no smaller than minProfile, that holds the model and meets the SLO.
+// Without such a slice it falls back to the smallest available slice holding the model, and returns "" if none does.
+func selectSlice(available map[string]int, profile ModelProfile, minProfile string, slo float64) string {
+	footprint := profile.footprintGB()
+	var fitting []string // available slices with enough memory, smallest first
+	reachedMin := minProfile == ""
+	for _, migConfig := range migConfigList {
+		reachedMin = reachedMin || migConfig == minProfile
+		if available[migConfig] <= 0 || !reachedMin {
+			continue
+		}
+		if sliceMemoryGB(migConfig) >= footprint {
+			fitting = append(fitting, migConfig)
+		}
+	}
+	log.Printf("Model needs %.1f GB, slices that fit: %v, SLO: %v s/token", footprint, fitting, slo)
+
+	if slo > 0 && len(profile.TokensPerSecond) > 0 {
+		for _, migConfig := range fitting {
+			if profile.TokensPerSecond[migConfig] >= 1/slo {
+				return migConfig
+			}
+		}
+		log.Printf("No available slice meets SLO %v s/token, ignoring SLO", slo)
+	}
+	if len(fitting) > 0 {
+		return fitting[0]
+	}
+	log.Printf("No available slice holds %.1f GB", footprint)
+	return ""
+}
+
+// sliceMemoryGB parses the memory of a MIG profile, ex. 20 for nvidia.com/mig-3g.20gb
+func sliceMemoryGB(migConfig string) float64 {
+	matches := sliceMemoryPattern.FindStringSubmatch(migConfig)
+	if len(matches) != 2 {
+		return 0
 	}
+	memory, _ := strconv.ParseFloat(matches[1], 64)
+	return memory
 }
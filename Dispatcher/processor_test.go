@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	servingv1 "knative.dev/serving/pkg/apis/serving/v1"
+)
+
+// withClusterCache serves the nodes and pods of a test from the cluster cache
+func withClusterCache(t *testing.T, nodes []*v1.Node, pods []*v1.Pod) {
+	nodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, node := range nodes {
+		nodeIndexer.Add(node)
+	}
+	podIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for i, pod := range pods {
+		pod.Name = fmt.Sprintf("pod-%d", i)
+		podIndexer.Add(pod)
+	}
+	saved := clusterCache
+	clusterCache = &ClusterCache{synced: true, nodes: corelisters.NewNodeLister(nodeIndexer), pods: corelisters.NewPodLister(podIndexer)}
+	t.Cleanup(func() { clusterCache = saved })
+}
+
+func TestResourceEstimate(t *testing.T) {
+	savedCatalog := modelCatalog
+	modelCatalog = &CatalogStore{catalog: ModelCatalog{Models: map[string]CatalogEntry{
+		"org/tiny": {MinProfile: mig2g},
+	}}}
+	t.Cleanup(func() { modelCatalog = savedCatalog })
+	savedProfiles := dispatcherConfig.Profiles
+	dispatcherConfig.Profiles = map[string]ModelProfile{
+		"org/quantized": {MemoryGB: 18, Variants: map[string]ModelProfile{"awq": {MemoryGB: 9}}},
+	}
+	t.Cleanup(func() { dispatcherConfig.Profiles = savedProfiles })
+	withClusterCache(t, []*v1.Node{testNode("n1", nil, map[string]int64{mig1g: 2, mig2g: 1, mig3g: 1})}, nil)
+
+	tests := []struct {
+		name       string
+		modelID    string
+		variant    string
+		quota      map[string]int
+		wantSlice  string
+		wantStatus int
+	}{
+		{name: "smallest free slice", modelID: "org/model-8B", wantSlice: mig3g},
+		{name: "within quota", modelID: "org/model-8B", quota: map[string]int{mig3g: 1}, wantSlice: mig3g},
+		{name: "a fitting slice over quota", modelID: "org/model-8B", quota: map[string]int{mig1g: 2}, wantStatus: http.StatusTooManyRequests},
+		{name: "no fitting slice regardless of quota", modelID: "org/model-70B", quota: map[string]int{mig3g: 1}, wantStatus: http.StatusServiceUnavailable},
+		{name: "unknown size from the catalog minimum profile", modelID: "org/tiny", wantSlice: mig2g},
+		{name: "unknown size without a minimum profile", modelID: "org/unknown", wantStatus: http.StatusBadRequest},
+		{name: "profile of the model", modelID: "org/quantized", wantSlice: mig3g},
+		{name: "profile of the variant", modelID: "org/quantized", variant: "awq", wantSlice: mig2g},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := testRequest(tt.modelID, "hi")
+			req.Variant = tt.variant
+			group := RequestGroup{Requests: []Request{req}}
+			estimate, err := Processor{}.ResourceEstimate(group, tt.quota)
+			if tt.wantStatus != 0 {
+				var dispatchErr *DispatchError
+				if !errors.As(err, &dispatchErr) || dispatchErr.StatusCode != tt.wantStatus {
+					t.Fatalf("ResourceEstimate() error = %v, want status %d", err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ResourceEstimate() error = %v", err)
+			}
+			if estimate.GPU_slices[tt.wantSlice] != 1 || len(estimate.GPU_slices) != 1 {
+				t.Errorf("slices = %v, want one %s", estimate.GPU_slices, tt.wantSlice)
+			}
+		})
+	}
+}
+
+func TestExceedsQuota(t *testing.T) {
+	now := time.Now()
+	quotaService := func(namespace, name string, age time.Duration, slices map[string]int64) servingv1.Service {
+		service := servingv1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, CreationTimestamp: metav1.NewTime(now.Add(-age))}}
+		container := v1.Container{Resources: v1.ResourceRequirements{Limits: v1.ResourceList{}}}
+		for migConfig, count := range slices {
+			container.Resources.Limits[v1.ResourceName(migConfig)] = *resource.NewQuantity(count, resource.DecimalSI)
+		}
+		service.Spec.Template.Spec.Containers = []v1.Container{container}
+		return service
+	}
+	deleted := quotaService("ns", "deleted", 4*time.Minute, map[string]int64{mig3g: 1})
+	deleted.DeletionTimestamp = &metav1.Time{Time: now}
+	services := []servingv1.Service{ // created concurrently against a quota of two 3g slices
+		quotaService("ns", "newer", time.Minute, map[string]int64{mig3g: 1}),
+		quotaService("ns", "older", 2*time.Minute, map[string]int64{mig3g: 1}),
+		quotaService("team-ns", "elsewhere", 3*time.Minute, map[string]int64{mig3g: 1}), // in the namespace of another model
+		quotaService("ns", "small", 2*time.Minute, map[string]int64{mig1g: 1}),
+		deleted,
+	}
+	quota := map[string]int{mig3g: 2}
+
+	for name, want := range map[string]bool{"older": false, "newer": true, "small": true, "missing": false} {
+		if got := exceedsQuota(services, quota, "ns", name); got != want {
+			t.Errorf("exceedsQuota(%s) = %v, want %v", name, got, want)
+		}
+	}
+	if exceedsQuota(services, quota, "team-ns", "older") {
+		t.Error("exceedsQuota() matched a service of another namespace")
+	}
+}
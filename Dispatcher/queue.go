@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQueueDepth    = 100
+	defaultMaxQueueTime  = 5 * time.Minute
+	defaultRetryAfter    = 5 * time.Second
+	defaultMaxTotalDepth = 1000
+	defaultMaxQueues     = 256
+	queueIdleTimeout     = time.Minute // an empty queue and its worker are removed after this, model names come from clients
+)
+
+// ModelQueue is the bounded queue of requests waiting to be grouped for one model of a tenant
+type ModelQueue struct {
+	key      string // queueKey of its requests
+	requests chan Request
+	policy   QueuePolicy // of the model, taken when the queue is created like its depth
+	batch    BatchPolicy // limits of the groups its worker forms
+}
+
+// QueueError is returned when a request is not admitted, clients should retry after RetryAfter if it is set
+type QueueError struct {
+	StatusCode int
+	RetryAfter time.Duration
+	Reason     string
+}
+
+func (e *QueueError) Error() string {
+	return e.Reason
+}
+
+var (
+	modelQueues = make(map[string]*ModelQueue) // Map to store the request queue of each model and tenant
+	queuesMu    sync.Mutex                     // Mutex to synchronize access to the modelQueues map
+)
+
+// enqueueRequest admits a request into the queue of its model without blocking
+func enqueueRequest(req Request) *QueueError {
+	if draining.Load() {
+		queueRejections.WithLabelValues(req.metricModel(), "draining").Inc()
+		return &QueueError{StatusCode: http.StatusServiceUnavailable, RetryAfter: dispatcherConfig.Queueing.RetryAfter.Duration, Reason: errShuttingDown.Error()}
+	}
+	if err := tenantStore.admit(req); err != nil {
+		return err
+	}
+	cfg := dispatcherConfig.Queueing
+	// requests are sent while holding the lock, so a queue removed as idle never receives another one
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+	totalDepth := 0
+	for _, q := range modelQueues {
+		totalDepth += len(q.requests)
+	}
+	if totalDepth >= cfg.MaxTotalDepth {
+		queueRejections.WithLabelValues(req.metricModel(), "overloaded").Inc()
+		return &QueueError{StatusCode: http.StatusServiceUnavailable, RetryAfter: cfg.RetryAfter.Duration, Reason: "dispatcher is overloaded"}
+	}
+
+	key := req.queueKey()
+	queue, ok := modelQueues[key]
+	if !ok {
+		// model ids come from clients, so the queues (and their workers) are bounded until idle ones are removed
+		if len(modelQueues) >= cfg.MaxQueues {
+			queueRejections.WithLabelValues(req.metricModel(), "overloaded").Inc()
+			return &QueueError{StatusCode: http.StatusServiceUnavailable, RetryAfter: cfg.RetryAfter.Duration, Reason: "too many models queued"}
+		}
+		policy := dispatcherConfig.queuePolicy(req.modelID())
+		queue = &ModelQueue{key: key, requests: make(chan Request, policy.Depth), policy: policy, batch: dispatcherConfig.batchPolicy(req.modelID())}
+		modelQueues[key] = queue
+		go worker(queue) // one grouping worker per model, so a full model does not stall the others
+	}
+
+	req.EnqueuedAt = time.Now()
+	select {
+	case queue.requests <- req:
+		queueDepth.WithLabelValues(key).Set(float64(len(queue.requests)))
+		return nil
+	default:
+		queueRejections.WithLabelValues(req.metricModel(), "full").Inc()
+		return &QueueError{StatusCode: http.StatusTooManyRequests, RetryAfter: cfg.RetryAfter.Duration, Reason: fmt.Sprintf("queue of model %s is full", req.Model)}
+	}
+}
+
+// dequeueRequest takes the next request from a queue, dropping requests that are stale or whose client left.
+// It returns false once the queue stayed empty for queueIdleTimeout and was removed, the worker then exits.
+func (q *ModelQueue) dequeueRequest() (Request, bool) {
+	idle := time.NewTimer(queueIdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case req := <-q.requests:
+			queueDepth.WithLabelValues(q.key).Set(float64(len(q.requests)))
+			if expireRequest(req, q.policy.MaxQueueTime.Duration) {
+				continue
+			}
+			return req, true
+		case <-idle.C:
+			if q.remove() {
+				return Request{}, false
+			}
+			idle.Reset(queueIdleTimeout)
+		}
+	}
+}
+
+// remove deletes an empty queue from modelQueues, the next request of the model creates a new one
+func (q *ModelQueue) remove() bool {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+	if len(q.requests) > 0 {
+		return false
+	}
+	if modelQueues[q.key] == q {
+		delete(modelQueues, q.key)
+	}
+	queueDepth.DeleteLabelValues(q.key)
+	log.Printf("Removed idle queue %s", q.key)
+	return true
+}
+
+// expireRequest answers a request that waited longer than the max queue time of its model or whose client went away, and reports whether it did
+func expireRequest(req Request, maxQueueTime time.Duration) bool {
+	if req.context().Err() != nil {
+		log.Printf("Dropping request %s, client went away", req.ID)
+		queueRejections.WithLabelValues(req.metricModel(), "cancelled").Inc()
+		return true
+	}
+	if waited := time.Since(req.EnqueuedAt); waited > maxQueueTime {
+		queueRejections.WithLabelValues(req.metricModel(), "expired").Inc()
+		rejectRequest(req, http.StatusServiceUnavailable, fmt.Errorf("request expired after waiting %s in queue", waited.Round(time.Second)))
+		return true
+	}
+	return false
+}
+
+// dropExpired removes the expired requests of a group before it is processed
+func dropExpired(group *RequestGroup) {
+	var alive []Request
+	for _, req := range group.Requests {
+		if expireRequest(req, dispatcherConfig.queuePolicy(req.modelID()).MaxQueueTime.Duration) {
+			group.TokenSum -= req.TokenSize
+			continue
+		}
+		alive = append(alive, req)
+	}
+	group.Requests = alive
+}
+
+// writeQueueError answers a rejected request with its status code and Retry-After header
+func writeQueueError(w http.ResponseWriter, err *QueueError) {
+	log.Printf("Request not admitted: %v", err)
+	if err.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(err.RetryAfter.Seconds()))))
+	}
+	http.Error(w, err.Error(), err.StatusCode)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// withQueues replaces the model queues and the queueing config for a test, queues added here have no worker.
+// Workers started by enqueueRequest keep the policies they were created with, and never read the config again
+func withQueues(t *testing.T, cfg QueueingConfig, queues map[string]*ModelQueue) {
+	savedQueues, savedCfg := modelQueues, dispatcherConfig.Queueing
+	modelQueues, dispatcherConfig.Queueing = queues, cfg
+	t.Cleanup(func() {
+		queuesMu.Lock()
+		defer queuesMu.Unlock()
+		modelQueues, dispatcherConfig.Queueing = savedQueues, savedCfg
+	})
+}
+
+func TestEnqueueRequest(t *testing.T) {
+	retryAfter := metav1.Duration{Duration: 3 * time.Second}
+	tests := []struct {
+		name       string
+		queued     map[string]int // requests already waiting per model, in queues of depth 2
+		maxTotal   int
+		maxQueues  int
+		model      string // of the new request, "a" if unset
+		wantStatus int    // 0 if admitted
+	}{
+		{name: "admitted", queued: map[string]int{"a": 1}, maxTotal: 10, maxQueues: 10},
+		{name: "full queue of the model", queued: map[string]int{"a": 2}, maxTotal: 10, maxQueues: 10, wantStatus: http.StatusTooManyRequests},
+		{name: "too many requests across models", queued: map[string]int{"a": 1, "b": 2}, maxTotal: 3, maxQueues: 10, wantStatus: http.StatusServiceUnavailable},
+		{name: "too many requests before a new queue", queued: map[string]int{"a": 2, "b": 1}, maxTotal: 3, maxQueues: 10, model: "c", wantStatus: http.StatusServiceUnavailable},
+		{name: "too many queues", queued: map[string]int{"a": 0, "b": 0}, maxTotal: 10, maxQueues: 2, model: "c", wantStatus: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queues := make(map[string]*ModelQueue)
+			for model, count := range tt.queued {
+				queues[model] = &ModelQueue{key: model, requests: make(chan Request, 2)}
+				for i := 0; i < count; i++ {
+					queues[model].requests <- testRequest(model, "queued")
+				}
+			}
+			withQueues(t, QueueingConfig{
+				Default:       QueuePolicy{Depth: 2, MaxQueueTime: metav1.Duration{Duration: time.Minute}},
+				MaxTotalDepth: tt.maxTotal,
+				MaxQueues:     tt.maxQueues,
+				RetryAfter:    retryAfter,
+			}, queues)
+
+			model := tt.model
+			if model == "" {
+				model = "a"
+			}
+			err := enqueueRequest(testRequest(model, "new"))
+			if tt.wantStatus == 0 {
+				if err != nil {
+					t.Fatalf("enqueueRequest() = %v, want admitted", err)
+				}
+				if got := len(queues["a"].requests); got != tt.queued["a"]+1 {
+					t.Errorf("queue holds %d requests, want %d", got, tt.queued["a"]+1)
+				}
+				return
+			}
+			if err == nil || err.StatusCode != tt.wantStatus {
+				t.Fatalf("enqueueRequest() = %v, want status %d", err, tt.wantStatus)
+			}
+			if len(queues) != len(tt.queued) {
+				t.Errorf("queue of rejected model %s created", model)
+			}
+			if err.RetryAfter != retryAfter.Duration {
+				t.Errorf("retry after %s, want %s", err.RetryAfter, retryAfter.Duration)
+			}
+			w := httptest.NewRecorder()
+			writeQueueError(w, err)
+			if w.Code != tt.wantStatus || w.Header().Get("Retry-After") != "3" {
+				t.Errorf("answered %d with Retry-After %q, want %d with 3", w.Code, w.Header().Get("Retry-After"), tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestDequeueRequest(t *testing.T) {
+	withQueues(t, QueueingConfig{Default: QueuePolicy{Depth: 4, MaxQueueTime: metav1.Duration{Duration: time.Minute}}}, map[string]*ModelQueue{})
+
+	expired := testRequest("a", "expired")
+	expired.EnqueuedAt = time.Now().Add(-2 * time.Minute)
+	cancelled := testRequest("a", "cancelled")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cancelled.ctx = ctx
+	fresh := testRequest("a", "fresh")
+	fresh.EnqueuedAt = time.Now()
+
+	queue := &ModelQueue{key: "a", requests: make(chan Request, 4), policy: QueuePolicy{MaxQueueTime: metav1.Duration{Duration: time.Minute}}}
+	queue.requests <- expired
+	queue.requests <- cancelled
+	queue.requests <- fresh
+
+	req, ok := queue.dequeueRequest()
+	if !ok || req.ID != fresh.ID {
+		t.Fatalf("dequeueRequest() = %q, %v, want the fresh request", req.ID, ok)
+	}
+	select {
+	case resp := <-expired.respChan:
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("expired request answered with %d, want 503", resp.StatusCode)
+		}
+	default:
+		t.Error("expired request not answered")
+	}
+	select {
+	case resp := <-cancelled.respChan:
+		t.Errorf("request of a client that went away answered with %d", resp.StatusCode)
+	default:
+	}
+}
+
+func TestRemoveIdleQueue(t *testing.T) {
+	idle := &ModelQueue{key: "idle", requests: make(chan Request, 1)}
+	busy := &ModelQueue{key: "busy", requests: make(chan Request, 1)}
+	busy.requests <- testRequest("busy", "queued")
+	withQueues(t, QueueingConfig{}, map[string]*ModelQueue{"idle": idle, "busy": busy})
+
+	if !idle.remove() {
+		t.Error("empty queue not removed")
+	}
+	if busy.remove() {
+		t.Error("queue with a waiting request removed")
+	}
+	if _, ok := modelQueues["idle"]; ok {
+		t.Error("removed queue still registered, new requests would never be read")
+	}
+	if modelQueues["busy"] != busy {
+		t.Error("busy queue unregistered")
+	}
+}
+
+func TestEnqueueRequestPerTenant(t *testing.T) {
+	withQueues(t, QueueingConfig{
+		Default:       QueuePolicy{Depth: 1, MaxQueueTime: metav1.Duration{Duration: time.Minute}},
+		MaxTotalDepth: 10,
+		MaxQueues:     10,
+	}, map[string]*ModelQueue{})
+	withTenants(t, "tenants: {}")
+	// the workers keep the requests in forming groups, no group is complete
+	savedBatching, savedGroups := dispatcherConfig.Batching, modelGroups
+	dispatcherConfig.Batching.Default = BatchPolicy{MaxSize: 10, MaxWait: metav1.Duration{Duration: time.Hour}}
+	mu.Lock()
+	modelGroups = make(map[string]RequestGroup)
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		dispatcherConfig.Batching, modelGroups = savedBatching, savedGroups
+	})
+
+	// both tenants are routed to one pinned service, a full queue of one does not refuse the other
+	for _, tenant := range []string{"team-a", "team-b", ""} {
+		req := testRequest("pinned", tenant)
+		req.tenant = tenant
+		if err := enqueueRequest(req); err != nil {
+			t.Errorf("request of tenant %q: %v", tenant, err)
+		}
+	}
+	queuesMu.Lock()
+	for _, key := range []string{"team-a/pinned", "team-b/pinned", "pinned"} {
+		if _, ok := modelQueues[key]; !ok {
+			t.Errorf("queue %s missing", key)
+		}
+	}
+	queuesMu.Unlock()
+
+	// and the requests of each tenant are grouped apart
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		formed := len(modelGroups)
+		mu.Unlock()
+		if formed == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d forming groups, want one per tenant", formed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	dispatcherPort          = "8080"
+	defaultDispatcherName   = "dispatcher" // Knative service of the Dispatcher, K_SERVICE overrides it
+	knativeServiceLabel     = "serving.knative.dev/service"
+	serviceAccountNamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+	defaultLeaseName        = "kubecomp-dispatcher"
+	defaultLeaseDuration    = 15 * time.Second
+	defaultRenewDeadline    = 10 * time.Second
+	defaultRetryPeriod      = 2 * time.Second
+	forwardedResultHeader   = "X-Dispatcher-Forwarded" // set on result lookups from another replica, which are not forwarded again
+	resultProxyTimeout      = 10 * time.Second
+)
+
+// Replica identifies this Dispatcher among its replicas. Any replica handles any request: services are created with
+// optimistic concurrency (a service created by another replica is waited for), updated with resource version retries,
+// and services are collected by the replica holding the leader Lease only.
+type Replica struct {
+	Name        string // pod name, the identity in the leader Lease
+	Namespace   string // namespace of the Lease
+	Service     string // Knative service the replicas run as, only its pods are asked for results
+	IP          net.IP // ids of asynchronous requests carry it, so every replica finds the one holding the result
+	leader      atomic.Bool
+	ctx         context.Context
+	stopLeading context.CancelFunc
+}
+
+var replica = newReplica()
+
+func newReplica() *Replica {
+	r := &Replica{Namespace: defaultNamespace, Service: defaultDispatcherName}
+	r.Name, _ = os.Hostname()
+	if service := os.Getenv("K_SERVICE"); service != "" {
+		r.Service = service
+	}
+	if namespace, err := os.ReadFile(serviceAccountNamespace); err == nil {
+		r.Namespace = strings.TrimSpace(string(namespace))
+	}
+	r.IP = net.ParseIP(os.Getenv("POD_IP"))
+	if r.IP == nil {
+		r.IP = interfaceIP()
+	}
+	r.ctx, r.stopLeading = context.WithCancel(context.Background())
+	return r
+}
+
+// interfaceIP returns the first non-loopback address of the pod
+func interfaceIP() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+			return ipNet.IP
+		}
+	}
+	return nil
+}
+
+// isLeader reports whether this replica manages the services in the background (idle collection)
+func (r *Replica) isLeader() bool {
+	return r.leader.Load()
+}
+
+// RunLeaderElection competes for the leader Lease until the replica shuts down. Outside of a cluster the replica
+// is alone and leads
+func (r *Replica) RunLeaderElection() {
+	cfg := dispatcherConfig.LeaderElection
+	clientset, err := newClientset()
+	if err != nil {
+		log.Printf("Error creating clientset: %v, running as the only replica", err)
+		r.leader.Store(true)
+		return
+	}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: cfg.LeaseName, Namespace: r.Namespace},
+		Client:     clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: r.Name},
+	}
+	for r.ctx.Err() == nil { // RunOrDie returns when the leadership is lost, stand for election again
+		leaderelection.RunOrDie(r.ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			Name:            cfg.LeaseName,
+			LeaseDuration:   cfg.LeaseDuration.Duration,
+			RenewDeadline:   cfg.RenewDeadline.Duration,
+			RetryPeriod:     cfg.RetryPeriod.Duration,
+			ReleaseOnCancel: true, // the next leader takes over right away on shutdown
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(context.Context) {
+					log.Printf("Replica %s is the leader", r.Name)
+					r.leader.Store(true)
+				},
+				OnStoppedLeading: func() {
+					log.Printf("Replica %s stopped leading", r.Name)
+					r.leader.Store(false)
+				},
+				OnNewLeader: func(identity string) {
+					if identity != r.Name {
+						log.Printf("Replica %s is the leader", identity)
+					}
+				},
+			},
+		})
+	}
+}
+
+// resultID prefixes a request id with the address of this replica
+func (r *Replica) resultID(id string) string {
+	if r.IP == nil {
+		return id
+	}
+	ip := r.IP.To4()
+	if ip == nil {
+		ip = r.IP
+	}
+	return hex.EncodeToString(ip) + "-" + id
+}
+
+// resultOwner returns the replica holding the result of an asynchronous request, nil if the id carries no address
+func resultOwner(id string) net.IP {
+	prefix, _, ok := strings.Cut(id, "-")
+	if !ok {
+		return nil
+	}
+	ip, err := hex.DecodeString(prefix)
+	if err != nil || (len(ip) != net.IPv4len && len(ip) != net.IPv6len) {
+		return nil
+	}
+	return net.IP(ip)
+}
+
+// isReplica reports whether an address belongs to a running pod of the Dispatcher. Result ids come from the client,
+// so an address not known from the cluster is never contacted.
+func (r *Replica) isReplica(ip net.IP) bool {
+	pods, err := clusterCache.Pods()
+	if err != nil {
+		log.Printf("Error listing Dispatcher replicas: %v", err)
+		return false
+	}
+	for _, pod := range pods {
+		if pod.Namespace == r.Namespace && pod.Labels[knativeServiceLabel] == r.Service &&
+			pod.Status.Phase == v1.PodRunning && ip.Equal(net.ParseIP(pod.Status.PodIP)) {
+			return true
+		}
+	}
+	return false
+}
+
+var resultProxyClient = &http.Client{Timeout: resultProxyTimeout}
+
+// proxyResult fetches the result of an asynchronous request from the replica holding it
+func proxyResult(w http.ResponseWriter, r *http.Request, owner net.IP) {
+	if !replica.isReplica(owner) {
+		log.Printf("Result %s names %s, not a Dispatcher replica", r.PathValue("id"), owner)
+		http.Error(w, "Result not found", http.StatusNotFound)
+		return
+	}
+	url := "http://" + net.JoinHostPort(owner.String(), dispatcherPort) + "/results/" + r.PathValue("id")
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		http.Error(w, "Result not found", http.StatusNotFound)
+		return
+	}
+	for _, header := range []string{"Authorization", "X-API-Key"} {
+		if value := r.Header.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+	req.Header.Set(forwardedResultHeader, replica.Name)
+
+	resp, err := resultProxyClient.Do(req)
+	if err != nil {
+		// the replica is gone and its results with it
+		log.Printf("Error fetching result from replica %s: %v", owner, err)
+		http.Error(w, "Result not found", http.StatusNotFound)
+		return
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
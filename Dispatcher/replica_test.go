@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// dispatcherPod is a pod of a Knative service with an address
+func dispatcherPod(namespace, service string, phase v1.PodPhase, ip string) *v1.Pod {
+	pod := testPod("node-1", phase, nil)
+	pod.Namespace = namespace
+	pod.Labels = map[string]string{knativeServiceLabel: service}
+	pod.Status.PodIP = ip
+	return pod
+}
+
+// withReplica replaces the replica this Dispatcher runs as
+func withReplica(t *testing.T, r *Replica) {
+	saved := replica
+	replica = r
+	t.Cleanup(func() { replica = saved })
+}
+
+func TestResultOwner(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   net.IP // of the replica generating the id
+		id   string // taken instead of an id generated by the replica if set
+		want net.IP
+	}{
+		{name: "ipv4 replica", ip: net.ParseIP("10.0.0.2"), want: net.ParseIP("10.0.0.2")},
+		{name: "ipv6 replica", ip: net.ParseIP("fd00::2"), want: net.ParseIP("fd00::2")},
+		{name: "replica without address", ip: nil, want: nil},
+		{name: "prefix is not hex", id: "zz000002-0123abcd", want: nil},
+		{name: "prefix is not an address", id: "0a00-0123abcd", want: nil},
+		{name: "no prefix", id: "0123abcd", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withReplica(t, &Replica{IP: tt.ip})
+			id := tt.id
+			if id == "" {
+				id = newRequestID()
+			}
+			if got := resultOwner(id); !got.Equal(tt.want) {
+				t.Errorf("resultOwner(%s) = %v, want %v", id, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsReplica(t *testing.T) {
+	withClusterCache(t, nil, []*v1.Pod{
+		dispatcherPod("kubecomp", "dispatcher", v1.PodRunning, "10.0.0.2"),
+		dispatcherPod("kubecomp", "dispatcher", v1.PodPending, "10.0.0.3"),
+		dispatcherPod("kubecomp", "org-model", v1.PodRunning, "10.0.0.4"),
+		dispatcherPod("other", "dispatcher", v1.PodRunning, "10.0.0.5"),
+	})
+	r := &Replica{Namespace: "kubecomp", Service: "dispatcher"}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.0.0.2", true},  // running Dispatcher pod
+		{"10.0.0.3", false}, // not running
+		{"10.0.0.4", false}, // pod of a model service
+		{"10.0.0.5", false}, // Dispatcher of another namespace
+		{"10.0.0.6", false}, // not a pod
+	}
+	for _, tt := range tests {
+		if got := r.isReplica(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isReplica(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestHandleResultOfUnknownOwner(t *testing.T) {
+	withClusterCache(t, nil, []*v1.Pod{
+		dispatcherPod("kubecomp", "dispatcher", v1.PodRunning, "10.0.0.2"),
+		dispatcherPod("kubecomp", "org-model", v1.PodRunning, "10.0.0.4"),
+	})
+	withReplica(t, &Replica{Namespace: "kubecomp", Service: "dispatcher", IP: net.ParseIP("10.0.0.2")})
+	savedClient := resultProxyClient
+	resultProxyClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("result fetched from %s, which is not a Dispatcher replica", req.URL.Host)
+		return nil, fmt.Errorf("not a replica")
+	})}
+	t.Cleanup(func() { resultProxyClient = savedClient })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /results/{id}", handleResult)
+	for _, owner := range []string{"10.0.0.4", "10.0.0.9"} {
+		id := (&Replica{IP: net.ParseIP(owner)}).resultID("0123abcd")
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/results/"+id, nil))
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("result of %s answered %d, want %d", owner, recorder.Code, http.StatusNotFound)
+		}
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -1,32 +1,74 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Single Request object
 type Request struct {
-	Model string                 // string field for model
-	Token string                 `json:"token"` // string field for token
-	Env   map[string]string      `json:"env"`   // map of strings for env
-	Par   map[string]interface{} `json:"par"`   // slice of maps for par
-	Label map[string]string      `json:"label"` // labels to add on pod
+	ID     string                 // generated identifier of the request
+	Model  string                 // string field for model
+	Token  string                 `json:"token"`  // string field for token
+	Env    map[string]string      `json:"env"`    // map of strings for env
+	Par    map[string]interface{} `json:"par"`    // slice of maps for par
+	Label  map[string]string      `json:"label"`  // labels to add on pod
+	Stream bool                   `json:"stream"` // relay tokens as server-sent events from generate_stream
+
+	TokenSize  int       // estimated number of prompt tokens
+	SLO        float64   // target mean seconds per output token from the "slo" label, 0 if not set
+	Priority   int       // rank of the priority class from the "priority" label or X-Priority header, 0 is the most urgent
+	Variant    string    // variant of the model from the "variant" label or X-Model-Variant header, ex. awq
+	Revision   string    // traffic tag or revision from the "revision" label or X-Model-Revision header, or pinned by the routing table
+	EnqueuedAt time.Time // admission into the model queue, used for the queue time deadline
+	ReceivedAt time.Time // arrival at the Dispatcher, used for the end-to-end latency
+
+	ctx      context.Context     // context of the originating HTTP request, cancelled when the client goes away
+	respChan chan Response       // channel to deliver the service response back to the HTTP handler
+	async    bool                // response is stored in the result store instead of sent back on the connection
+	tenant   string              // authenticated tenant, empty for anonymous requests
+	chat     []OpenAIChatMessage // messages of an OpenAI chat request, sent to the chat endpoint of the service
+
+	duplicates []Request // identical requests answered with the response of this one
+}
+
+// Response holds the result of forwarding a request to its service
+type Response struct {
+	StatusCode int           // status code returned by the service
+	Header     http.Header   // headers returned by the service
+	Body       []byte        // response body returned by the service
+	Stream     io.ReadCloser // event stream returned by the service for streaming requests, closed by the reader
+	Err        error         // set when the request could not be forwarded or answered, with StatusCode if it was rejected
 }
+
 type RequestGroup struct {
-	Requests []Request
+	Requests  []Request
+	TokenSum  int       // estimated prompt tokens of all requests in the group
+	MinSLO    float64   // strictest SLO of the requests in the group, 0 if none is set
+	CreatedAt time.Time // arrival of the first request, used for the batching max wait
+	Priority  int       // rank of the priority class shared by the requests in the group
+}
+
+// flow is the fair queuing flow of a group: its tenant, or its model for anonymous requests
+func (g RequestGroup) flow() string {
+	if tenant := g.Requests[0].tenant; tenant != "" {
+		return tenant
+	}
+	return g.Requests[0].modelID()
 }
 
 var (
-	requestChannel = make(chan Request, 100)       // Channel to receive incoming requests
-	modelGroups    = make(map[string]RequestGroup) // Map to store requests grouped by model
-	processChannel = make(chan RequestGroup, 100)  // Channel to send preprocessed groups to sequential processor
-	mu             sync.Mutex                      // Mutex to synchronize access to the modelGroups map
+	modelGroups = make(map[string]RequestGroup) // Map to store requests grouped by tenant, model and priority
+	mu          sync.Mutex                      // Mutex to synchronize access to the modelGroups map
 )
 
 // parseRequest extracts data from the JSON payload and returns a Request object
@@ -47,41 +89,181 @@ func parseRequest(r *http.Request) Request {
 		return Request{}
 	}
 
+	return prepareRequest(r, req)
+}
+
+// prepareRequest routes a request to its service and attaches an ID and response delivery to it
+func prepareRequest(r *http.Request, req Request) Request {
 	// Check if "MODEL_ID" exists in req.Env
-	invalidPattern := regexp.MustCompile(`[^a-z0-9]+`)
-	if MODEL_ID, ok := req.Env["MODEL_ID"]; ok {
-		// Find the index of the last "/"
-		if idx := strings.LastIndex(MODEL_ID, "/"); idx != -1 {
-			req.Model = strings.ToLower(MODEL_ID[idx+1:]) // Extract substring after the last "/"
-		} else {
-			req.Model = strings.ToLower(MODEL_ID) // If no "/" is found, keep the original value
-		}
-		// Remove characters that do not match the regex pattern
-		req.Model = invalidPattern.ReplaceAllString(req.Model, "")
-		if req.Model == "" {
-			log.Printf("Error: No valid model ID after applying regex")
-			return Request{}
-		}
-	} else {
+	if strings.TrimSpace(req.Env["MODEL_ID"]) == "" {
 		log.Printf("Error: MODEL_ID not found in request")
-		// Optionally return an empty Request or handle the case as needed
 		return Request{}
 	}
+	req.Variant = requestOption(r, req.Label, variantLabel, "X-Model-Variant")
+	req.Revision = requestOption(r, req.Label, revisionLabel, "X-Model-Revision")
+
+	// Requests of a tenant are served by the tenant's own services, with the tokens of its Secret
+	if tenant := tenantStore.Get(tenantName(r)); tenant != nil {
+		req.tenant = tenant.Name
+		if tenant.Secret != "" {
+			for _, key := range tenant.SecretKeys {
+				if _, ok := req.Env[key]; ok {
+					log.Printf("Ignoring %s from the request env, it is taken from Secret %s", key, tenant.Secret)
+					delete(req.Env, key)
+				}
+			}
+		}
+	}
+
+	// The routing table maps the model, variant and tenant to a service, and may pin a revision
+	model, revision := resolveRoute(Route{ModelID: req.modelID(), Variant: req.Variant, Tenant: req.tenant})
+	req.Model = model
+	if req.Revision == "" {
+		req.Revision = revision
+	}
 
 	log.Printf("Token: %s", req.Token)
-	log.Printf("Model: %s", req.Model)
-	log.Printf("Env: %v", req.Env)
+	log.Printf("Model: %s, variant: %q, revision: %q", req.Model, req.Variant, req.Revision)
+	log.Printf("Env: %v", redactEnv(req.Env))
 	log.Printf("Par: %v", req.Par)
 	log.Printf("SLO: %v", req.Label)
+	log.Printf("Stream: %v", req.Stream)
 
+	req.TokenSize = estimateTokens(req.Token)
+	if label, ok := req.Label[sloLabel]; ok {
+		slo, err := strconv.ParseFloat(label, 64)
+		if err != nil || slo < 0 {
+			log.Printf("Invalid SLO label %q, ignoring", label)
+		} else {
+			req.SLO = slo
+		}
+	}
+	req.ReceivedAt = time.Now()
+	req.Priority = requestPriority(r, req.Label)
+	req.ID = newRequestID()
+	log.Printf("Request ID: %s", req.ID)
+	if isAsyncRequest(r) {
+		// the client will poll for the result, so the request must outlive the connection
+		req.async = true
+		req.Stream = false // there is no connection to stream the tokens to
+		req.ctx = context.Background()
+		resultStore.Put(req.ID, req.Model, req.tenant)
+	} else {
+		req.ctx = r.Context()
+		req.respChan = make(chan Response, 1)
+	}
 	return req
 }
 
+// requestPriority returns the rank of the priority class named by the X-Priority header or the priority label
+func requestPriority(r *http.Request, label map[string]string) int {
+	priority := r.Header.Get("X-Priority")
+	if labelPriority, ok := label[priorityLabel]; ok {
+		priority = labelPriority
+	}
+	if priority == "" {
+		priority = dispatcherConfig.Scheduling.DefaultPriority
+	}
+	rank, ok := dispatcherConfig.priorityRank(priority)
+	if !ok {
+		log.Printf("Unknown priority %q, using %s", priority, dispatcherConfig.Scheduling.DefaultPriority)
+		rank, _ = dispatcherConfig.priorityRank(dispatcherConfig.Scheduling.DefaultPriority)
+	}
+	return rank
+}
+
+// requestOption returns a request label, or the header standing for it when the label is not set
+func requestOption(r *http.Request, label map[string]string, key, header string) string {
+	if value, ok := label[key]; ok {
+		return value
+	}
+	return r.Header.Get(header)
+}
+
+// queueKey identifies the queue and processing slot of a request: its model, and its tenant so tenants routed
+// to one service (ex. a route pinned for every tenant) never share a queue, a group or a service spec
+func (r Request) queueKey() string {
+	if r.tenant == "" {
+		return r.Model
+	}
+	return r.tenant + "/" + r.Model
+}
+
+// groupKey identifies the forming group of a request, requests are batched with requests of the same queue, revision and priority
+func (r Request) groupKey() string {
+	return fmt.Sprintf("%s/%s/%d", r.queueKey(), r.Revision, r.Priority)
+}
+
+// isAsyncRequest checks whether the client asked for an asynchronous request (?async=true or Prefer: respond-async)
+func isAsyncRequest(r *http.Request) bool {
+	if async, err := strconv.ParseBool(r.URL.Query().Get("async")); err == nil && async {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Prefer"), "respond-async")
+}
+
+// respond delivers the response of a request back to the waiting HTTP handler or the result store
+func (req Request) respond(resp Response) {
+	for _, duplicate := range req.duplicates {
+		duplicate.respond(resp)
+	}
+	if req.async {
+		resultStore.Complete(req.ID, resp)
+		observeResponse(req, resp)
+		return
+	}
+	if req.respChan == nil {
+		return
+	}
+	select {
+	case req.respChan <- resp:
+		observeResponse(req, resp)
+	default:
+		log.Printf("Response for model %s already delivered, dropping", req.Model)
+	}
+}
+
+// modelID returns the hugging face model id of a request
+func (req Request) modelID() string {
+	return req.Env["MODEL_ID"]
+}
+
+// metricModel returns the model label of the metrics of a request
+func (req Request) metricModel() string {
+	return modelLabel(req.modelID(), req.Model)
+}
+
+// context returns the context of the originating HTTP request
+func (req Request) context() context.Context {
+	if req.ctx == nil {
+		return context.Background()
+	}
+	return req.ctx
+}
+
+// waitersContext is done once every waiting client went away, a request answering its duplicates is forwarded
+// (and kept when it is queued or buffered) as long as one of them waits. Asynchronous requests always wait.
+func waitersContext(requests []Request) context.Context {
+	for _, req := range requests {
+		if req.context().Done() == nil {
+			return context.Background()
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for _, req := range requests {
+			<-req.context().Done()
+		}
+		cancel()
+	}()
+	return ctx
+}
+
 // getOrCreateRequestGroup retrieves or creates a new RequestGroup for a given model
-func getOrCreateRequestGroup(model string) RequestGroup {
-	group, exists := modelGroups[model]
+func getOrCreateRequestGroup(key string, priority int) RequestGroup {
+	group, exists := modelGroups[key]
 	if !exists {
-		group = RequestGroup{}
+		group = RequestGroup{CreatedAt: time.Now(), Priority: priority}
 	}
 	return group
 }
@@ -89,8 +271,8 @@ func getOrCreateRequestGroup(model string) RequestGroup {
 // addRequestToGroup adds a request to a request group and updates its properties
 func addRequestToGroup(group *RequestGroup, req Request) {
 	group.Requests = append(group.Requests, req)
-	// group.TokenSum += req.TokenSize
-	// if req.SLO < group.MinSLO || group.MinSLO == 0 {
-	// 	group.MinSLO = req.SLO
-	// }
+	group.TokenSum += req.TokenSize
+	if req.SLO > 0 && (req.SLO < group.MinSLO || group.MinSLO == 0) {
+		group.MinSLO = req.SLO
+	}
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultResultTTL = 1 * time.Hour // how long finished results are kept before being evicted
+
+type ResultState string
+
+const (
+	ResultPending ResultState = "pending"
+	ResultDone    ResultState = "done"
+	ResultFailed  ResultState = "failed"
+)
+
+// Result is the stored outcome of an asynchronous request
+type Result struct {
+	ID         string          `json:"id"`
+	Model      string          `json:"model"`
+	Tenant     string          `json:"-"` // only the tenant of the request may read its result
+	State      ResultState     `json:"state"`
+	StatusCode int             `json:"status_code,omitempty"`
+	Body       json.RawMessage `json:"body,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+}
+
+// ResultStore persists the results of asynchronous requests until they are collected
+type ResultStore interface {
+	Put(id, model, tenant string)      // register a pending request
+	Complete(id string, resp Response) // record the response of a request
+	Get(id string) (Result, bool)      // look up a request's result
+	Pending() int                      // count the requests not completed yet
+}
+
+// MemoryResultStore keeps results in process memory and evicts them after a TTL
+type MemoryResultStore struct {
+	mu         sync.Mutex
+	results    map[string]*Result
+	ttl        time.Duration // of finished results, after their last update
+	pendingTTL time.Duration // of pending results, after their creation
+}
+
+var resultStore ResultStore = NewMemoryResultStore(dispatcherConfig.Results.TTL.Duration, dispatcherConfig.maxRequestTime())
+
+// NewMemoryResultStore creates an in-memory store and starts its eviction loop. Pending results are kept until
+// pendingTTL, the longest a request can be served, so a request still running is never answered with 404
+func NewMemoryResultStore(ttl, pendingTTL time.Duration) *MemoryResultStore {
+	s := &MemoryResultStore{
+		results:    make(map[string]*Result),
+		ttl:        ttl,
+		pendingTTL: max(pendingTTL, ttl),
+	}
+	go s.evictLoop()
+	return s
+}
+
+func (s *MemoryResultStore) Put(id, model, tenant string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.results[id] = &Result{
+		ID:        id,
+		Model:     model,
+		Tenant:    tenant,
+		State:     ResultPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+func (s *MemoryResultStore) Complete(id string, resp Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, ok := s.results[id]
+	if !ok {
+		log.Printf("Result %s not found in store, dropping response", id)
+		return
+	}
+
+	result.UpdatedAt = time.Now()
+	result.StatusCode = resp.StatusCode
+	switch {
+	case resp.Err != nil:
+		result.State = ResultFailed
+		result.Error = resp.Err.Error()
+	case resp.StatusCode >= http.StatusBadRequest:
+		result.State = ResultFailed
+		result.Error = http.StatusText(resp.StatusCode)
+	default:
+		result.State = ResultDone
+	}
+	if len(resp.Body) > 0 {
+		if json.Valid(resp.Body) {
+			result.Body = json.RawMessage(resp.Body)
+		} else {
+			result.Body, _ = json.Marshal(string(resp.Body)) // keep non-json bodies as a json string
+		}
+	}
+}
+
+func (s *MemoryResultStore) Get(id string) (Result, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, ok := s.results[id]
+	if !ok {
+		return Result{}, false
+	}
+	return *result, true
+}
+
+func (s *MemoryResultStore) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, result := range s.results {
+		if result.State == ResultPending {
+			count++
+		}
+	}
+	return count
+}
+
+// evictLoop periodically removes results older than the TTL
+func (s *MemoryResultStore) evictLoop() {
+	ticker := time.NewTicker(s.ttl / 10)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.evict(time.Now())
+	}
+}
+
+// evict removes the finished results not updated within the TTL, and the pending ones older than the pending TTL
+func (s *MemoryResultStore) evict(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, result := range s.results {
+		if result.State == ResultPending {
+			if now.Sub(result.CreatedAt) > s.pendingTTL {
+				log.Printf("Evicting result %s, still pending after %s", id, s.pendingTTL)
+				delete(s.results, id)
+			}
+		} else if now.Sub(result.UpdatedAt) > s.ttl {
+			delete(s.results, id)
+		}
+	}
+}
+
+// newRequestID generates a random identifier for a request, prefixed with the replica holding its result
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Error generating request ID: %v", err)
+	}
+	return replica.resultID(hex.EncodeToString(b))
+}
+
+// handleResult serves GET /results/{id} with the state of an asynchronous request
+func handleResult(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	result, ok := resultStore.Get(id)
+	if owner := resultOwner(id); !ok && owner != nil && !owner.Equal(replica.IP) && r.Header.Get(forwardedResultHeader) == "" {
+		proxyResult(w, r, owner) // held by another replica
+		return
+	}
+	if !ok || result.Tenant != tenantName(r) {
+		http.Error(w, "Result not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMemoryResultStoreEvict(t *testing.T) {
+	store := &MemoryResultStore{results: make(map[string]*Result), ttl: time.Minute, pendingTTL: 30 * time.Minute}
+	store.Put("done", "model", "")
+	store.Complete("done", Response{StatusCode: http.StatusOK, Body: []byte(`{}`)})
+	store.Put("running", "model", "") // cold start and generation outlast the TTL
+
+	store.evict(time.Now().Add(2 * time.Minute))
+	if _, ok := store.Get("done"); ok {
+		t.Error("finished result kept after the TTL")
+	}
+	if result, ok := store.Get("running"); !ok || result.State != ResultPending {
+		t.Fatalf("pending result = %+v, %v, want it kept while the request runs", result, ok)
+	}
+
+	store.evict(time.Now().Add(31 * time.Minute))
+	if _, ok := store.Get("running"); ok {
+		t.Error("pending result kept after the longest a request can be served")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	servingv1 "knative.dev/serving/pkg/apis/serving/v1"
+)
+
+const (
+	variantLabel       = "variant"               // request label naming a model variant, ex. awq, overrides the X-Model-Variant header
+	revisionLabel      = "revision"              // request label naming a traffic tag or revision, overrides the X-Model-Revision header
+	modelIDAnnotation  = "kubecomp.com/model-id" // route of the services created by the Dispatcher
+	variantAnnotation  = "kubecomp.com/variant"
+	maxServiceName     = 50 // revision names append -00001 and tag routes prefix <tag>- within the 63 characters of a DNS label
+	serviceNameHashLen = 8
+)
+
+var nameInvalidPattern = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Route is what a request is served by: a model, one of its variants (ex. quantized or fine-tuned), for a tenant
+type Route struct {
+	ModelID string
+	Variant string
+	Tenant  string
+}
+
+// RoutingConfig is the routing table, routes without an entry get a derived service name and the default traffic
+type RoutingConfig struct {
+	Routes []RouteConfig `json:"routes"` // the first matching entry wins
+}
+
+// RouteConfig pins the matching routes to a service name or a revision
+type RouteConfig struct {
+	Model    string `json:"model"`    // MODEL_ID or pattern like meta-llama/*
+	Variant  string `json:"variant"`  // "" matches requests without a variant, "*" any variant
+	Tenant   string `json:"tenant"`   // "" matches anonymous requests, "*" any tenant
+	Service  string `json:"service"`  // service name, derived from the route if unset
+	Revision string `json:"revision"` // traffic tag (or tagged revision) the requests go to unless they name one, ex. for an A/B test
+}
+
+func (c RouteConfig) matches(route Route) bool {
+	matched, _ := path.Match(c.Model, route.ModelID)
+	return matched && (c.Variant == "*" || c.Variant == route.Variant) && (c.Tenant == "*" || c.Tenant == route.Tenant)
+}
+
+// pinnedService returns the service a routing table entry names for a route, "" if the name is derived
+func pinnedService(route Route) string {
+	for _, entry := range dispatcherConfig.Routing.Routes {
+		if entry.matches(route) {
+			return entry.Service
+		}
+	}
+	return ""
+}
+
+// resolveRoute returns the service of a route and the revision its requests are pinned to, if any
+func resolveRoute(route Route) (string, string) {
+	for _, entry := range dispatcherConfig.Routing.Routes {
+		if !entry.matches(route) {
+			continue
+		}
+		name := entry.Service
+		if name == "" {
+			name = serviceName(route)
+		}
+		return name, entry.Revision
+	}
+	return serviceName(route), ""
+}
+
+// serviceName derives a stable service name from a route: a readable prefix from the tenant, the model name and the
+// variant, and a hash of the whole route, so models of different orgs or differing only in punctuation do not collide
+func serviceName(route Route) string {
+	modelName := route.ModelID[strings.LastIndex(route.ModelID, "/")+1:]
+	var parts []string
+	for _, part := range []string{route.Tenant, modelName, route.Variant} {
+		if part = strings.Trim(nameInvalidPattern.ReplaceAllString(strings.ToLower(part), "-"), "-"); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	readable := strings.Join(parts, "-")
+	if readable == "" || readable[0] < 'a' {
+		readable = "m-" + readable // names start with a letter
+	}
+	readable = strings.TrimRight(readable[:min(len(readable), maxServiceName-serviceNameHashLen-1)], "-")
+
+	digest := sha256.Sum256([]byte(route.Tenant + "\x00" + route.ModelID + "\x00" + route.Variant))
+	return readable + "-" + hex.EncodeToString(digest[:])[:serviceNameHashLen]
+}
+
+// checkRoute refuses to send a route to an existing service created for another route, ex. a service of the same name
+// created by hand. Routes the routing table pins to the same service share it, ex. the variants matched by "*".
+func checkRoute(spec ServiceSpec, service *servingv1.Service) error {
+	modelID, ok := service.Annotations[modelIDAnnotation]
+	if !ok {
+		return nil // not created by the Dispatcher, or before routes were recorded
+	}
+	created := Route{ModelID: modelID, Variant: service.Annotations[variantAnnotation], Tenant: service.Labels[tenantLabel]}
+	requested := Route{ModelID: spec.ModelID, Variant: spec.Variant, Tenant: spec.Tenant}
+	if created == requested || (pinnedService(created) == service.Name && pinnedService(requested) == service.Name) {
+		return nil
+	}
+	return newDispatchError(http.StatusConflict, "route to service "+spec.key(),
+		fmt.Errorf("service serves %s variant %q, not %s variant %q", modelID, created.Variant, spec.ModelID, spec.Variant))
+}
+
+// revisionTag returns the traffic tag reaching a revision of a service, by tag or by the name of a tagged revision
+func revisionTag(service *servingv1.Service, revision string) (string, error) {
+	for _, traffic := range service.Status.Traffic {
+		if traffic.Tag != "" && (traffic.Tag == revision || traffic.RevisionName == revision) {
+			return traffic.Tag, nil
+		}
+	}
+	log.Printf("Revision %s of service %s/%s has no traffic tag", revision, service.Namespace, service.Name)
+	return "", newDispatchError(http.StatusNotFound, "route to revision "+revision,
+		fmt.Errorf("service %s/%s has no traffic tag for %s", service.Namespace, service.Name, revision))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	servingv1 "knative.dev/serving/pkg/apis/serving/v1"
+)
+
+// dnsLabel is what Knative accepts as a service name
+var dnsLabel = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+
+func TestServiceName(t *testing.T) {
+	tests := []struct {
+		name       string
+		route      Route
+		wantPrefix string
+	}{
+		{name: "model", route: Route{ModelID: "meta-llama/Meta-Llama-3.1-8B"}, wantPrefix: "meta-llama-3-1-8b-"},
+		{name: "tenant and variant", route: Route{ModelID: "meta-llama/Meta-Llama-3.1-8B", Variant: "awq", Tenant: "team-a"}, wantPrefix: "team-a-meta-llama-3-1-8b-awq-"},
+		{name: "starts with a digit", route: Route{ModelID: "org/123b"}, wantPrefix: "m-123b-"},
+		{name: "nothing readable", route: Route{ModelID: "org/___"}, wantPrefix: "m-"},
+		{name: "long", route: Route{ModelID: "org/" + strings.Repeat("very-long-model-name-", 5), Variant: "awq", Tenant: "team-a"}, wantPrefix: "team-a-very-long-model-name-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := serviceName(tt.route)
+			if !strings.HasPrefix(name, tt.wantPrefix) {
+				t.Errorf("serviceName() = %q, want prefix %q", name, tt.wantPrefix)
+			}
+			if len(name) > maxServiceName || !dnsLabel.MatchString(name) {
+				t.Errorf("serviceName() = %q (%d characters), want a DNS label of at most %d", name, len(name), maxServiceName)
+			}
+			if again := serviceName(tt.route); again != name {
+				t.Errorf("serviceName() = %q then %q, want a stable name", name, again)
+			}
+		})
+	}
+}
+
+func TestServiceNameCollisions(t *testing.T) {
+	// routes whose readable parts are equal
+	routes := []Route{
+		{ModelID: "org-a/llama"},
+		{ModelID: "org-b/llama"},
+		{ModelID: "org-a/Llama"},
+		{ModelID: "org-a/llama_"},
+		{ModelID: "org-a/llama", Variant: "awq"},
+		{ModelID: "org-a/llama-awq"},
+		{ModelID: "org-a/llama", Tenant: "team-a"},
+		{ModelID: "org-a/team-a-llama"},
+		{ModelID: "org-a/llama", Tenant: "a", Variant: "b"},
+		{ModelID: "org-a/llama", Tenant: "a-b"},
+		{ModelID: "org/" + strings.Repeat("x", 60) + "1"},
+		{ModelID: "org/" + strings.Repeat("x", 60) + "2"},
+	}
+	seen := make(map[string]Route)
+	for _, route := range routes {
+		name := serviceName(route)
+		if other, ok := seen[name]; ok {
+			t.Errorf("serviceName(%+v) = serviceName(%+v) = %q", route, other, name)
+		}
+		seen[name] = route
+	}
+}
+
+func TestCheckRoute(t *testing.T) {
+	routes := dispatcherConfig.Routing.Routes
+	dispatcherConfig.Routing.Routes = []RouteConfig{{Model: "org/pinned", Variant: "*", Tenant: "*", Service: "pinned"}}
+	t.Cleanup(func() { dispatcherConfig.Routing.Routes = routes })
+
+	service := func(name, modelID, variant string) *servingv1.Service {
+		annotations := map[string]string{}
+		if modelID != "" {
+			annotations[modelIDAnnotation], annotations[variantAnnotation] = modelID, variant
+		}
+		return &servingv1.Service{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations}}
+	}
+	tests := []struct {
+		name    string
+		spec    ServiceSpec
+		service *servingv1.Service
+		wantErr bool
+	}{
+		{name: "same route", spec: ServiceSpec{ModelID: "org/a", Variant: "awq"}, service: service("a", "org/a", "awq")},
+		{name: "other model", spec: ServiceSpec{ModelID: "org/b"}, service: service("a", "org/a", ""), wantErr: true},
+		{name: "other variant", spec: ServiceSpec{ModelID: "org/a", Variant: "awq"}, service: service("a", "org/a", ""), wantErr: true},
+		{name: "not created by the Dispatcher", spec: ServiceSpec{ModelID: "org/b"}, service: service("a", "", "")},
+		{name: "variants pinned to one service", spec: ServiceSpec{ModelID: "org/pinned", Variant: "awq"}, service: service("pinned", "org/pinned", "")},
+		{name: "pinned name taken by another model", spec: ServiceSpec{ModelID: "org/pinned"}, service: service("pinned", "org/a", ""), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkRoute(tt.spec, tt.service); (err != nil) != tt.wantErr {
+				t.Errorf("checkRoute() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	servingv1 "knative.dev/serving/pkg/apis/serving/v1"
+)
+
+const redactedValue = "<redacted>"
+
+// sensitiveHeaders carry credentials of the clients, their values are never logged
+var sensitiveHeaders = []string{"Authorization", "X-API-Key", "Proxy-Authorization", "Cookie"}
+
+// defaultSensitiveKeys are env keys (or patterns) whose values are tokens, never logged nor written into a service spec
+var defaultSensitiveKeys = []string{"HF_TOKEN", "HUGGING_FACE_HUB_TOKEN", "*_TOKEN", "*_KEY", "*_SECRET", "*PASSWORD*"}
+
+// isSensitiveKey reports whether an env key matches one of the configured sensitive keys, ignoring case
+func isSensitiveKey(key string) bool {
+	key = strings.ToUpper(key)
+	for _, pattern := range dispatcherConfig.Secrets.SensitiveKeys {
+		if matched, _ := path.Match(strings.ToUpper(pattern), key); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// redactHeader returns a copy of request headers that is safe to log
+func redactHeader(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, key := range sensitiveHeaders {
+		if _, ok := redacted[http.CanonicalHeaderKey(key)]; ok {
+			redacted.Set(key, redactedValue)
+		}
+	}
+	return redacted
+}
+
+// redactEnv returns a copy of an env map that is safe to log
+func redactEnv(env map[string]string) map[string]string {
+	redacted := make(map[string]string, len(env))
+	for key, value := range env {
+		if isSensitiveKey(key) {
+			value = redactedValue
+		}
+		redacted[key] = value
+	}
+	return redacted
+}
+
+// splitSensitiveEnv separates the sensitive values of an env map from the plain ones
+func splitSensitiveEnv(env map[string]string) (plain, sensitive map[string]string) {
+	plain, sensitive = make(map[string]string), make(map[string]string)
+	for key, value := range env {
+		if isSensitiveKey(key) {
+			sensitive[key] = value
+		} else {
+			plain[key] = value
+		}
+	}
+	return plain, sensitive
+}
+
+// envSecretName is the Secret generated for the sensitive env of a service
+func envSecretName(serviceName string) string {
+	return serviceName + "-env"
+}
+
+// secretEnvVar reads an env var from a key of a Secret
+func secretEnvVar(key, secretName string) v1.EnvVar {
+	return v1.EnvVar{
+		Name: key,
+		ValueFrom: &v1.EnvVarSource{SecretKeyRef: &v1.SecretKeySelector{
+			LocalObjectReference: v1.LocalObjectReference{Name: secretName},
+			Key:                  key,
+		}},
+	}
+}
+
+// applyEnvSecret creates the Secret holding the sensitive env of a service, or updates it with the latest values
+func applyEnvSecret(ctx context.Context, clientset kubernetes.Interface, namespace, serviceName string, data map[string]string) error {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      envSecretName(serviceName),
+			Namespace: namespace,
+			Labels:    map[string]string{"serving.knative.dev/service": serviceName},
+		},
+		Type:       v1.SecretTypeOpaque,
+		StringData: data,
+	}
+	secrets := clientset.CoreV1().Secrets(namespace)
+	_, err := secrets.Create(ctx, secret, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		// keep the owner of the existing Secret, so deleting its service still deletes the tokens
+		err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			existing, err := secrets.Get(ctx, secret.Name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			secret.OwnerReferences, secret.ResourceVersion = existing.OwnerReferences, existing.ResourceVersion
+			_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Stored %d sensitive env values of service %s in Secret %s", len(data), serviceName, secret.Name)
+	return nil
+}
+
+// ownEnvSecret makes the generated Secret of a service owned by it, so deleting the service deletes the tokens
+func ownEnvSecret(ctx context.Context, clientset kubernetes.Interface, service *servingv1.Service) {
+	secrets := clientset.CoreV1().Secrets(service.Namespace)
+	secret, err := secrets.Get(ctx, envSecretName(service.Name), metav1.GetOptions{})
+	if err != nil {
+		log.Printf("Error getting Secret of service %s: %v", service.Name, err)
+		return
+	}
+	secret.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: servingv1.SchemeGroupVersion.String(),
+		Kind:       "Service",
+		Name:       service.Name,
+		UID:        service.UID,
+	}}
+	if _, err := secrets.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		log.Printf("Error setting owner of Secret %s: %v", secret.Name, err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSensitiveEnv(t *testing.T) {
+	saved := dispatcherConfig.Secrets.SensitiveKeys
+	dispatcherConfig.Secrets.SensitiveKeys = defaultSensitiveKeys
+	t.Cleanup(func() { dispatcherConfig.Secrets.SensitiveKeys = saved })
+
+	env := map[string]string{
+		"HF_TOKEN":         "hf_secret",
+		"GITHUB_TOKEN":     "gh_secret", // *_TOKEN
+		"openai_api_key":   "sk_secret", // *_KEY, ignoring case
+		"AWS_SECRET":       "aws_secret",
+		"DB_PASSWORD_FILE": "pw_secret", // *PASSWORD*
+		"MODEL_ID":         "org/model",
+		"MAX_TOTAL_TOKENS": "4096", // ends in TOKENS, not _TOKEN
+		"TOKENIZER":        "fast",
+		"KEYCLOAK_REALM":   "realm",
+		"NUM_SHARD":        "1",
+	}
+	sensitive := map[string]bool{"HF_TOKEN": true, "GITHUB_TOKEN": true, "openai_api_key": true, "AWS_SECRET": true, "DB_PASSWORD_FILE": true}
+
+	redacted := redactEnv(env)
+	wantPlain, wantSensitive := make(map[string]string), make(map[string]string)
+	for key, value := range env {
+		want := value
+		if sensitive[key] {
+			want = redactedValue
+			wantSensitive[key] = value
+		} else {
+			wantPlain[key] = value
+		}
+		if redacted[key] != want {
+			t.Errorf("redactEnv()[%s] = %q, want %q", key, redacted[key], want)
+		}
+	}
+	if env["HF_TOKEN"] != "hf_secret" {
+		t.Error("redactEnv() changed the env it was given")
+	}
+
+	plain, secret := splitSensitiveEnv(env)
+	if !reflect.DeepEqual(plain, wantPlain) || !reflect.DeepEqual(secret, wantSensitive) {
+		t.Errorf("splitSensitiveEnv() = %v, %v, want %v, %v", plain, secret, wantPlain, wantSensitive)
+	}
+}
+
+func TestRedactHeader(t *testing.T) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer sk_secret")
+	header.Set("x-api-key", "key_secret")
+	header.Set("Cookie", "session=secret")
+	header.Set("Content-Type", "application/json")
+
+	redacted := redactHeader(header)
+	for _, key := range []string{"Authorization", "X-Api-Key", "Cookie"} {
+		if got := redacted.Get(key); got != redactedValue {
+			t.Errorf("%s = %q, want %q", key, got, redactedValue)
+		}
+	}
+	if got := redacted.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want it kept", got)
+	}
+	if header.Get("Authorization") != "Bearer sk_secret" {
+		t.Error("redactHeader() changed the request headers")
+	}
+}
+
+func TestApplyEnvSecret(t *testing.T) {
+	owner := metav1.OwnerReference{APIVersion: "serving.knative.dev/v1", Kind: "Service", Name: "svc", UID: "uid"}
+	clientset := fake.NewSimpleClientset(&v1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Name:            envSecretName("svc"),
+		Namespace:       "ns",
+		OwnerReferences: []metav1.OwnerReference{owner},
+	}, StringData: map[string]string{"HF_TOKEN": "old"}})
+
+	if err := applyEnvSecret(context.Background(), clientset, "ns", "svc", map[string]string{"HF_TOKEN": "new"}); err != nil {
+		t.Fatalf("applyEnvSecret() = %v", err)
+	}
+	secret, err := clientset.CoreV1().Secrets("ns").Get(context.Background(), envSecretName("svc"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.StringData["HF_TOKEN"] != "new" {
+		t.Errorf("HF_TOKEN = %q, want the latest value", secret.StringData["HF_TOKEN"])
+	}
+	if len(secret.OwnerReferences) != 1 || secret.OwnerReferences[0] != owner {
+		t.Errorf("owners = %v, want the service still owning the tokens", secret.OwnerReferences)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const defaultReadyTimeout = 10 * time.Minute // image pull and model download of a cold start
+
+// ServiceState is the lifecycle state of a Knative service as seen by the Dispatcher
+type ServiceState int
+
+const (
+	ServiceAbsent   ServiceState = iota // not known to the Dispatcher
+	ServiceCreating                     // created (or found not ready), requests are buffered until it is ready
+	ServiceReady                        // requests are forwarded directly
+	ServiceFailed                       // did not become ready in time, the next group retries
+)
+
+func (s ServiceState) String() string {
+	switch s {
+	case ServiceCreating:
+		return "creating"
+	case ServiceReady:
+		return "ready"
+	case ServiceFailed:
+		return "failed"
+	default:
+		return "absent"
+	}
+}
+
+type serviceEntry struct {
+	state       ServiceState
+	buffered    []PackedRequest // requests waiting for the service to become ready
+	since       time.Time       // when the service entered its state
+	lastRequest time.Time       // last request forwarded to (or buffered for) the service, used to collect idle services
+	published   time.Time       // last request recorded on the service for the leader, see publishLastRequests
+}
+
+// ServiceLifecycle tracks the state of every service, so a service is created once
+// and the requests arriving during its cold start wait for it instead of creating it again
+type ServiceLifecycle struct {
+	mu       sync.Mutex
+	services map[string]*serviceEntry
+}
+
+var serviceLifecycle = NewServiceLifecycle()
+
+func NewServiceLifecycle() *ServiceLifecycle {
+	return &ServiceLifecycle{services: make(map[string]*serviceEntry)}
+}
+
+// buffer holds requests for a service being created and reports whether it did
+func (l *ServiceLifecycle) buffer(name string, packedRequests []PackedRequest) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.services[name]
+	if !ok || entry.state != ServiceCreating {
+		return false
+	}
+	entry.buffered = append(entry.buffered, packedRequests...)
+	entry.lastRequest = time.Now()
+	log.Printf("Service %s is being created, buffered %d requests (%d waiting)", name, len(packedRequests), len(entry.buffered))
+	return true
+}
+
+// startCreating moves a service to creating and buffers the requests. It reports whether the caller
+// owns the creation, false means another group started it and the requests just wait
+func (l *ServiceLifecycle) startCreating(name string, packedRequests []PackedRequest) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.services[name]
+	if !ok {
+		entry = &serviceEntry{since: time.Now()}
+		l.services[name] = entry
+	}
+	entry.buffered = append(entry.buffered, packedRequests...)
+	entry.lastRequest = time.Now()
+	if entry.state == ServiceCreating {
+		return false
+	}
+	entry.state = ServiceCreating
+	entry.since = time.Now()
+	return true
+}
+
+// markReady moves a service to ready and returns the requests buffered during its creation
+func (l *ServiceLifecycle) markReady(name string) []PackedRequest {
+	return l.transition(name, ServiceReady)
+}
+
+// markFailed moves a service to failed and returns the requests buffered during its creation, which must be answered
+func (l *ServiceLifecycle) markFailed(name string) []PackedRequest {
+	return l.transition(name, ServiceFailed)
+}
+
+// touch records a request for a service
+func (l *ServiceLifecycle) touch(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if entry, ok := l.services[name]; ok {
+		entry.lastRequest = time.Now()
+	}
+}
+
+// idleSince returns when a service last got a request. Services unknown to this replica (ex. created before
+// a restart) are tracked from the last request published on them, or from now on as if they just got one.
+func (l *ServiceLifecycle) idleSince(name string, published time.Time) (ServiceState, time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.services[name]
+	if !ok {
+		lastRequest := published
+		if lastRequest.IsZero() {
+			lastRequest = time.Now()
+		}
+		entry = &serviceEntry{state: ServiceReady, since: time.Now(), lastRequest: lastRequest, published: lastRequest}
+		l.services[name] = entry
+	}
+	return entry.state, entry.lastRequest
+}
+
+// unpublished returns the services that got a request since their last request was last published, marking them published
+func (l *ServiceLifecycle) unpublished() map[string]time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lastRequests := make(map[string]time.Time)
+	for name, entry := range l.services {
+		if entry.lastRequest.After(entry.published) {
+			lastRequests[name] = entry.lastRequest
+			entry.published = entry.lastRequest
+		}
+	}
+	return lastRequests
+}
+
+// forget drops a deleted service, its next request creates it again
+func (l *ServiceLifecycle) forget(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if entry, ok := l.services[name]; ok && entry.state != ServiceCreating {
+		delete(l.services, name)
+	}
+}
+
+// bufferedCount counts the requests waiting for a service to become ready
+func (l *ServiceLifecycle) bufferedCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	count := 0
+	for _, entry := range l.services {
+		count += len(entry.buffered)
+	}
+	return count
+}
+
+// dropBuffered returns and forgets the requests waiting for a service to become ready, which must be answered
+func (l *ServiceLifecycle) dropBuffered() []PackedRequest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var dropped []PackedRequest
+	for _, entry := range l.services {
+		dropped = append(dropped, entry.buffered...)
+		entry.buffered = nil
+	}
+	return dropped
+}
+
+func (l *ServiceLifecycle) transition(name string, state ServiceState) []PackedRequest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.services[name]
+	if !ok {
+		entry = &serviceEntry{since: time.Now()}
+		l.services[name] = entry
+	}
+	if entry.state != state {
+		log.Printf("Service %s: %s -> %s after %s", name, entry.state, state, time.Since(entry.since).Round(time.Second))
+		entry.state = state
+		entry.since = time.Now()
+	}
+	buffered := entry.buffered
+	entry.buffered = nil
+	return buffered
+}
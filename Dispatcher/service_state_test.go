@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	servinglisters "knative.dev/serving/pkg/client/listers/serving/v1"
+)
+
+// lifecycleStep is an operation on a service lifecycle and its expected outcome
+type lifecycleStep struct {
+	op        string   // start, buffer, ready or failed
+	requests  []string // ids of the requests passed to start and buffer
+	wantOwner bool     // result of start and buffer
+	wantIDs   []string // requests returned by ready and failed
+	wantState ServiceState
+}
+
+func packedRequests(ids ...string) []PackedRequest {
+	packed := make([]PackedRequest, 0, len(ids))
+	for _, id := range ids {
+		packed = append(packed, PackedRequest{Request: testRequest("org/model", id)})
+	}
+	return packed
+}
+
+func TestServiceLifecycle(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []lifecycleStep
+	}{
+		{"buffered requests are flushed on ready in arrival order", []lifecycleStep{
+			{op: "start", requests: []string{"a"}, wantOwner: true, wantState: ServiceCreating},
+			{op: "buffer", requests: []string{"b", "c"}, wantOwner: true, wantState: ServiceCreating},
+			{op: "start", requests: []string{"d"}, wantOwner: false, wantState: ServiceCreating},
+			{op: "ready", wantIDs: []string{"a", "b", "c", "d"}, wantState: ServiceReady},
+			{op: "ready", wantState: ServiceReady},
+		}},
+		{"ready service is not buffered for", []lifecycleStep{
+			{op: "start", requests: []string{"a"}, wantOwner: true, wantState: ServiceCreating},
+			{op: "ready", wantIDs: []string{"a"}, wantState: ServiceReady},
+			{op: "buffer", requests: []string{"b"}, wantOwner: false, wantState: ServiceReady},
+		}},
+		{"unknown service is not buffered for", []lifecycleStep{
+			{op: "buffer", requests: []string{"a"}, wantOwner: false, wantState: ServiceAbsent},
+		}},
+		{"failed service returns its buffered requests and is created again", []lifecycleStep{
+			{op: "start", requests: []string{"a"}, wantOwner: true, wantState: ServiceCreating},
+			{op: "buffer", requests: []string{"b"}, wantOwner: true, wantState: ServiceCreating},
+			{op: "failed", wantIDs: []string{"a", "b"}, wantState: ServiceFailed},
+			{op: "buffer", requests: []string{"c"}, wantOwner: false, wantState: ServiceFailed},
+			{op: "start", requests: []string{"c"}, wantOwner: true, wantState: ServiceCreating},
+			{op: "ready", wantIDs: []string{"c"}, wantState: ServiceReady},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lifecycle := NewServiceLifecycle()
+			for i, step := range tt.steps {
+				var owner bool
+				var flushed []PackedRequest
+				switch step.op {
+				case "start":
+					owner = lifecycle.startCreating("ns/svc", packedRequests(step.requests...))
+				case "buffer":
+					owner = lifecycle.buffer("ns/svc", packedRequests(step.requests...))
+				case "ready":
+					flushed = lifecycle.markReady("ns/svc")
+				case "failed":
+					flushed = lifecycle.markFailed("ns/svc")
+				}
+				if owner != step.wantOwner {
+					t.Errorf("step %d %s = %v, want %v", i, step.op, owner, step.wantOwner)
+				}
+				var ids []string
+				for _, packed := range flushed {
+					ids = append(ids, packed.Request.ID)
+				}
+				if !reflect.DeepEqual(ids, step.wantIDs) {
+					t.Errorf("step %d %s flushed %v, want %v", i, step.op, ids, step.wantIDs)
+				}
+				state := ServiceAbsent
+				if entry, ok := lifecycle.services["ns/svc"]; ok {
+					state = entry.state
+				}
+				if state != step.wantState {
+					t.Errorf("step %d %s: state %s, want %s", i, step.op, state, step.wantState)
+				}
+			}
+		})
+	}
+}
+
+func TestServiceLifecycleStartCreatingOnce(t *testing.T) {
+	lifecycle := NewServiceLifecycle()
+	const groups = 50
+	var owners sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for i := 0; i < groups; i++ {
+		owners.Add(1)
+		go func() {
+			defer owners.Done()
+			if lifecycle.startCreating("ns/svc", packedRequests(fmt.Sprint(i))) {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}()
+	}
+	owners.Wait()
+
+	if created != 1 {
+		t.Errorf("%d groups own the creation, want 1", created)
+	}
+	if got := lifecycle.bufferedCount(); got != groups {
+		t.Errorf("%d requests buffered, want %d", got, groups)
+	}
+	if got := len(lifecycle.markReady("ns/svc")); got != groups {
+		t.Errorf("%d requests flushed on ready, want %d", got, groups)
+	}
+}
+
+func TestWaitForServiceReadyTimeout(t *testing.T) {
+	savedLifecycle, savedCache := serviceLifecycle, clusterCache
+	serviceLifecycle = NewServiceLifecycle()
+	// the service never shows up in the cache
+	clusterCache = &ClusterCache{synced: true, services: servinglisters.NewServiceLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}))}
+	savedTimeout := dispatcherConfig.Services.ReadyTimeout
+	dispatcherConfig.Services.ReadyTimeout = metav1.Duration{Duration: time.Millisecond}
+	t.Cleanup(func() {
+		serviceLifecycle, clusterCache = savedLifecycle, savedCache
+		dispatcherConfig.Services.ReadyTimeout = savedTimeout
+	})
+
+	spec := ServiceSpec{Namespace: "ns", Name: "svc", ModelID: "org/model"}
+	buffered := packedRequests("a", "b")
+	serviceLifecycle.startCreating(spec.key(), buffered[:1])
+	serviceLifecycle.buffer(spec.key(), buffered[1:])
+
+	(&Assigner{}).waitForServiceReadyAndForward(spec)
+
+	for _, packed := range buffered {
+		select {
+		case resp := <-packed.Request.respChan:
+			if resp.StatusCode != http.StatusGatewayTimeout {
+				t.Errorf("request %s answered %d, want %d", packed.Request.ID, resp.StatusCode, http.StatusGatewayTimeout)
+			}
+		default:
+			t.Errorf("request %s not answered after the ready timeout", packed.Request.ID)
+		}
+	}
+	if state, _ := serviceLifecycle.idleSince(spec.key(), time.Time{}); state != ServiceFailed {
+		t.Errorf("state after the ready timeout = %s, want %s", state, ServiceFailed)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultDrainTimeout = 30 * time.Second       // keep below the termination grace period of the pod (timeoutSeconds of the revision)
+	drainCheckInterval  = 100 * time.Millisecond // how often the drain checks for remaining work
+	dropGracePeriod     = time.Second            // time for handlers to write the 503 of dropped requests before exit
+)
+
+var errShuttingDown = errors.New("dispatcher is shutting down")
+
+// draining is set once the Dispatcher is terminated, new requests are answered with 503 so clients retry elsewhere
+// and forming groups are flushed without waiting for their max wait
+var draining atomic.Bool
+
+// drainReport counts the requests left at the drain deadline
+type drainReport struct {
+	queued         int // in the queue of a model
+	forming        int // in a forming group
+	waiting        int // in a complete group waiting for a slot
+	buffered       int // waiting for the cold start of a service
+	pendingResults int // asynchronous requests still being served, their results are lost
+}
+
+func (r drainReport) empty() bool {
+	return r.queued+r.forming+r.waiting+r.buffered+r.pendingResults == 0
+}
+
+// serve runs the HTTP server until SIGTERM or SIGINT, then drains the requests in flight
+func serve(server *http.Server) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go func() {
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	<-ctx.Done()
+	stop() // a second signal kills the Dispatcher right away
+	shutdown(server, dispatcherConfig.Shutdown.DrainTimeout.Duration)
+}
+
+// shutdown stops admitting requests, lets the admitted ones be served until the drain timeout and answers the rest with 503
+func shutdown(server *http.Server, timeout time.Duration) {
+	log.Printf("Shutting down, draining requests for up to %s", timeout)
+	draining.Store(true)
+	replica.stopLeading() // release the Lease, another replica takes over the idle collection
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Shutdown closes the listener and waits for the handlers of synchronous requests, which return once answered.
+	// Asynchronous requests are done when their result is stored
+	served := make(chan struct{})
+	go func() {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down HTTP server: %v", err)
+		}
+		close(served)
+	}()
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			report := dropPending()
+			log.Printf("Drain timed out, dropped %d queued, %d forming, %d waiting and %d cold start requests, "+
+				"%d asynchronous requests were still being served",
+				report.queued, report.forming, report.waiting, report.buffered, report.pendingResults)
+			graceCtx, graceCancel := context.WithTimeout(context.Background(), dropGracePeriod)
+			server.Shutdown(graceCtx)
+			graceCancel()
+			server.Close()
+			return
+		case <-ticker.C:
+			select {
+			case <-served:
+				if pendingWork().empty() {
+					log.Printf("Drained every request, exiting")
+					return
+				}
+			default:
+			}
+		}
+	}
+}
+
+// pendingWork counts the admitted requests not answered yet, except those being forwarded synchronously
+func pendingWork() drainReport {
+	var report drainReport
+	queuesMu.Lock()
+	for _, queue := range modelQueues {
+		report.queued += len(queue.requests)
+	}
+	queuesMu.Unlock()
+	mu.Lock()
+	for _, group := range modelGroups {
+		report.forming += len(group.Requests)
+	}
+	mu.Unlock()
+	report.waiting = groupPool.pending()
+	report.buffered = serviceLifecycle.bufferedCount()
+	report.pendingResults = resultStore.Pending()
+	return report
+}
+
+// dropPending answers every request that was not handed to a service yet with 503, clients may retry on another replica
+func dropPending() drainReport {
+	var report drainReport
+	var dropped []Request
+
+	queuesMu.Lock()
+	for _, queue := range modelQueues {
+	drain:
+		for {
+			select {
+			case req := <-queue.requests:
+				dropped = append(dropped, req)
+				report.queued++
+			default:
+				break drain
+			}
+		}
+	}
+	queuesMu.Unlock()
+
+	mu.Lock()
+	for key, group := range modelGroups {
+		delete(modelGroups, key)
+		dropped = append(dropped, group.Requests...)
+		report.forming += len(group.Requests)
+	}
+	mu.Unlock()
+
+	for _, group := range groupPool.drop() {
+		dropped = append(dropped, group.Requests...)
+		report.waiting += len(group.Requests)
+	}
+
+	for _, packed := range serviceLifecycle.dropBuffered() {
+		packed.Payload.Close()
+		dropped = append(dropped, packed.Request)
+		report.buffered++
+	}
+
+	for _, req := range dropped {
+		queueRejections.WithLabelValues(req.metricModel(), "shutdown").Inc()
+		rejectRequest(req, http.StatusServiceUnavailable, errShuttingDown)
+	}
+	report.pendingResults = resultStore.Pending()
+	return report
+}
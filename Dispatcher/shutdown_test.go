@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDropPending(t *testing.T) {
+	savedQueues, savedGroups, savedPool, savedLifecycle := modelQueues, modelGroups, groupPool, serviceLifecycle
+	t.Cleanup(func() {
+		modelQueues, modelGroups, groupPool, serviceLifecycle = savedQueues, savedGroups, savedPool, savedLifecycle
+	})
+
+	queued := testRequest("org/a", "queued")
+	forming := testRequest("org/a", "forming")
+	waiting := testRequest("org/b", "waiting")
+	buffered := testRequest("org/c", "buffered")
+
+	modelQueues = map[string]*ModelQueue{"org/a": {key: "org/a", requests: make(chan Request, 1)}}
+	modelQueues["org/a"].requests <- queued
+	modelGroups = map[string]RequestGroup{forming.groupKey(): {Requests: []Request{forming}}}
+	groupPool = NewKeyedPool(0, func(RequestGroup) { t.Error("group processed without a free slot") })
+	groupPool.Submit("org/b", RequestGroup{Requests: []Request{waiting}})
+	serviceLifecycle = NewServiceLifecycle()
+	serviceLifecycle.startCreating("c", []PackedRequest{{Request: buffered, Payload: io.NopCloser(strings.NewReader("{}"))}})
+
+	report := dropPending()
+	if report.queued != 1 || report.forming != 1 || report.waiting != 1 || report.buffered != 1 {
+		t.Errorf("report = %+v, want one request of each kind", report)
+	}
+	for _, req := range []Request{queued, forming, waiting, buffered} {
+		select {
+		case resp := <-req.respChan:
+			if resp.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("%s request answered with %d, want 503", req.ID, resp.StatusCode)
+			}
+		default:
+			t.Errorf("%s request not answered", req.ID)
+		}
+	}
+	if remaining := pendingWork(); !remaining.empty() {
+		t.Errorf("work left after dropping = %+v", remaining)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+)
+
+// writeStream relays the server-sent events of a streaming response to the client, flushing after every event
+func writeStream(w http.ResponseWriter, r *http.Request, resp Response) {
+	defer resp.Stream.Close()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(resp.StatusCode)
+	flusher.Flush()
+
+	// Events are separated by a blank line, flush at each boundary so every token reaches the client immediately
+	reader := bufio.NewReader(resp.Stream)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if _, werr := w.Write(line); werr != nil {
+				log.Printf("Client disconnected while streaming: %v", werr)
+				return
+			}
+			if len(bytes.TrimSpace(line)) == 0 {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			if err != io.EOF && r.Context().Err() == nil {
+				log.Printf("Error reading event stream from service: %v", err)
+			}
+			flusher.Flush()
+			return
+		}
+	}
+}
+
+// readEvents calls onData with the payload of every "data:" line of a server-sent events stream
+func readEvents(stream io.Reader, onData func(data []byte) error) error {
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if !bytes.HasPrefix(line, []byte("data:")) {
+			continue
+		}
+		if err := onData(bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:")))); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
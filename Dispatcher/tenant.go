@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	defaultTenantsPath = "/etc/dispatcher-tenants/tenants.yaml" // mounted from the dispatcher-tenants Secret
+	tenantLabel        = "kubecomp.com/tenant"                  // label of the services created for a tenant
+)
+
+// defaultSecretKeys are the env keys taken from the Secret of a tenant when it does not list its own
+var defaultSecretKeys = []string{"HF_TOKEN"}
+
+// tenantNamePattern keeps tenant names usable as label values and service name prefixes
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// Tenant is a client of the Dispatcher, identified by its API keys
+type Tenant struct {
+	Name       string          `json:"-"`          // key of the tenant in the registry
+	APIKeys    []string        `json:"apiKeys"`    // sha256 hex digests of the keys, ex. echo -n $KEY | sha256sum
+	Namespace  string          `json:"namespace"`  // namespace of the tenant's services, the services namespace if unset
+	Models     []string        `json:"models"`     // allowed model ids or patterns like meta-llama/*, all models if empty
+	RateLimit  RateLimitConfig `json:"rateLimit"`  // admitted requests, unlimited if unset
+	GPUQuota   map[string]int  `json:"gpuQuota"`   // MIG slices per profile the tenant's services may hold, unlimited if empty
+	Secret     string          `json:"secret"`     // Secret in the tenant namespace holding the tenant's tokens
+	SecretKeys []string        `json:"secretKeys"` // env keys read from the Secret, HF_TOKEN if empty
+}
+
+// RateLimitConfig is a token bucket refilled at RequestsPerSecond holding up to Burst requests
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	Burst             int     `json:"burst"`
+}
+
+// TenantRegistry is the tenants file
+type TenantRegistry struct {
+	Tenants map[string]Tenant `json:"tenants"`
+}
+
+// TenantStore holds the current tenants and reloads them when the mounted file changes.
+// Without a tenants file authentication is disabled and every request is anonymous.
+type TenantStore struct {
+	mu       sync.RWMutex
+	tenants  map[string]*Tenant       // by name
+	byKey    map[string]string        // sha256 of an API key to tenant name
+	limiters map[string]*rate.Limiter // by tenant name
+	path     string
+	raw      []byte
+}
+
+type tenantContextKey struct{}
+
+var tenantStore = NewTenantStore()
+
+func NewTenantStore() *TenantStore {
+	tenantsPath := os.Getenv("TENANTS")
+	if tenantsPath == "" {
+		tenantsPath = defaultTenantsPath
+	}
+	store := &TenantStore{path: tenantsPath, limiters: make(map[string]*rate.Limiter)}
+	store.reload()
+	return store
+}
+
+// Watch polls the tenants file and reloads it on change
+func (s *TenantStore) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.reload()
+	}
+}
+
+func (s *TenantStore) reload() {
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		if s.raw == nil {
+			log.Printf("Could not read tenants %s: %v, authentication is disabled", s.path, err)
+			s.raw = []byte{}
+		}
+		return
+	}
+	if bytes.Equal(raw, s.raw) {
+		return
+	}
+	s.raw = raw
+
+	var registry TenantRegistry
+	if err := yaml.Unmarshal(raw, &registry); err != nil {
+		log.Printf("Invalid tenants %s: %v, keeping previous tenants", s.path, err)
+		return
+	}
+
+	tenants := make(map[string]*Tenant)
+	byKey := make(map[string]string)
+	for name, tenant := range registry.Tenants {
+		if !tenantNamePattern.MatchString(name) {
+			log.Printf("Invalid tenant name %q, skipping", name)
+			continue
+		}
+		tenant.Name = name
+		if len(tenant.SecretKeys) == 0 {
+			tenant.SecretKeys = defaultSecretKeys
+		}
+		for _, key := range tenant.APIKeys {
+			byKey[strings.ToLower(key)] = name
+		}
+		tenants[name] = &tenant
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	limiters := make(map[string]*rate.Limiter)
+	for name, tenant := range tenants {
+		if tenant.RateLimit.RequestsPerSecond <= 0 {
+			continue
+		}
+		burst := tenant.RateLimit.Burst
+		if burst <= 0 {
+			burst = 1
+		}
+		limiter, ok := s.limiters[name]
+		if !ok || limiter.Limit() != rate.Limit(tenant.RateLimit.RequestsPerSecond) || limiter.Burst() != burst {
+			limiter = rate.NewLimiter(rate.Limit(tenant.RateLimit.RequestsPerSecond), burst)
+		}
+		limiters[name] = limiter
+	}
+	s.tenants, s.byKey, s.limiters = tenants, byKey, limiters
+	log.Printf("Loaded %d tenants", len(tenants))
+}
+
+// enabled reports whether requests must carry an API key
+func (s *TenantStore) enabled() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.tenants) > 0
+}
+
+// Get returns a tenant by name, nil for anonymous requests or removed tenants
+func (s *TenantStore) Get(name string) *Tenant {
+	if name == "" {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tenants[name]
+}
+
+// authenticate returns the tenant owning an API key
+func (s *TenantStore) authenticate(apiKey string) (*Tenant, bool) {
+	digest := sha256.Sum256([]byte(apiKey))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	name, ok := s.byKey[hex.EncodeToString(digest[:])]
+	if !ok {
+		return nil, false
+	}
+	return s.tenants[name], true
+}
+
+// admit checks that the tenant of a request may use its model and is within its rate limit
+func (s *TenantStore) admit(req Request) *QueueError {
+	tenant := s.Get(req.tenant)
+	if tenant == nil {
+		return nil
+	}
+	if !tenant.allowsModel(req.modelID()) {
+		queueRejections.WithLabelValues(req.metricModel(), "forbidden").Inc()
+		return &QueueError{StatusCode: http.StatusForbidden, Reason: fmt.Sprintf("tenant %s may not use model %s", tenant.Name, req.modelID())}
+	}
+
+	s.mu.RLock()
+	limiter := s.limiters[tenant.Name]
+	s.mu.RUnlock()
+	if limiter != nil && !limiter.Allow() {
+		queueRejections.WithLabelValues(req.metricModel(), "rate_limited").Inc()
+		retryAfter := time.Duration(float64(time.Second) / float64(limiter.Limit()))
+		return &QueueError{StatusCode: http.StatusTooManyRequests, RetryAfter: retryAfter, Reason: fmt.Sprintf("rate limit of tenant %s exceeded", tenant.Name)}
+	}
+	return nil
+}
+
+func (t *Tenant) allowsModel(modelID string) bool {
+	if len(t.Models) == 0 {
+		return true
+	}
+	for _, pattern := range t.Models {
+		if matched, _ := path.Match(pattern, modelID); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// requireTenant authenticates requests with an API key (Authorization: Bearer or X-API-Key) once tenants are configured
+// and passes the tenant on in the request context
+func requireTenant(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !tenantStore.enabled() {
+			next(w, r)
+			return
+		}
+		apiKey := r.Header.Get("X-API-Key")
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			apiKey = strings.TrimSpace(bearer)
+		}
+		tenant, ok := tenantStore.authenticate(apiKey)
+		if apiKey == "" || !ok {
+			log.Printf("Rejecting unauthenticated request to %s", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			if strings.HasPrefix(r.URL.Path, "/v1/") {
+				writeOpenAIError(w, http.StatusUnauthorized, "invalid or missing API key")
+			} else {
+				http.Error(w, "invalid or missing API key", http.StatusUnauthorized)
+			}
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, tenant.Name)))
+	}
+}
+
+// tenantName returns the tenant authenticated for an HTTP request, empty for anonymous requests
+func tenantName(r *http.Request) string {
+	name, _ := r.Context().Value(tenantContextKey{}).(string)
+	return name
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withTenants loads a tenants file into the tenant store for a test
+func withTenants(t *testing.T, tenants string) *TenantStore {
+	path := filepath.Join(t.TempDir(), "tenants.yaml")
+	if err := os.WriteFile(path, []byte(tenants), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TENANTS", path)
+	saved := tenantStore
+	tenantStore = NewTenantStore()
+	t.Cleanup(func() { tenantStore = saved })
+	return tenantStore
+}
+
+func apiKeyDigest(key string) string {
+	digest := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(digest[:])
+}
+
+func TestRequireTenant(t *testing.T) {
+	withTenants(t, `
+tenants:
+  team-a:
+    apiKeys: [`+apiKeyDigest("key-a")+`]
+  Invalid_Name:
+    apiKeys: [`+apiKeyDigest("key-invalid")+`]
+`)
+	tests := []struct {
+		name       string
+		path       string
+		header     http.Header
+		wantStatus int
+		wantTenant string
+	}{
+		{name: "bearer token", path: "/", header: http.Header{"Authorization": {"Bearer key-a"}}, wantStatus: http.StatusOK, wantTenant: "team-a"},
+		{name: "api key header", path: "/", header: http.Header{"X-Api-Key": {"key-a"}}, wantStatus: http.StatusOK, wantTenant: "team-a"},
+		{name: "missing key", path: "/", header: http.Header{}, wantStatus: http.StatusUnauthorized},
+		{name: "unknown key", path: "/", header: http.Header{"Authorization": {"Bearer key-b"}}, wantStatus: http.StatusUnauthorized},
+		{name: "key of a skipped tenant", path: "/", header: http.Header{"X-Api-Key": {"key-invalid"}}, wantStatus: http.StatusUnauthorized},
+		{name: "OpenAI error body", path: "/v1/completions", header: http.Header{}, wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tenant := ""
+			handler := requireTenant(func(w http.ResponseWriter, r *http.Request) { tenant = tenantName(r) })
+			r := httptest.NewRequest("POST", tt.path, nil)
+			r.Header = tt.header
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if w.Code != tt.wantStatus || tenant != tt.wantTenant {
+				t.Errorf("answered %d for tenant %q, want %d for %q", w.Code, tenant, tt.wantStatus, tt.wantTenant)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Error("401 without WWW-Authenticate")
+			}
+			if strings.HasPrefix(tt.path, "/v1/") && !strings.Contains(w.Body.String(), `"error"`) {
+				t.Errorf("OpenAI route answered %q", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestRequireTenantDisabled(t *testing.T) {
+	store := withTenants(t, "tenants: {}")
+	if store.enabled() {
+		t.Fatal("tenants enabled without any tenant")
+	}
+	called := false
+	w := httptest.NewRecorder()
+	requireTenant(func(http.ResponseWriter, *http.Request) { called = true })(w, httptest.NewRequest("POST", "/", nil))
+	if !called {
+		t.Errorf("anonymous request answered with %d while authentication is disabled", w.Code)
+	}
+}
+
+func TestTenantAdmit(t *testing.T) {
+	store := withTenants(t, `
+tenants:
+  team-a:
+    apiKeys: [`+apiKeyDigest("key-a")+`]
+    models: [meta-llama/*]
+    rateLimit: {requestsPerSecond: 0.001, burst: 2}
+  team-b:
+    apiKeys: [`+apiKeyDigest("key-b")+`]
+`)
+	request := func(tenant, modelID string) Request {
+		req := testRequest(modelID, "hi")
+		req.tenant = tenant
+		return req
+	}
+
+	if err := store.admit(request("team-a", "org/other")); err == nil || err.StatusCode != http.StatusForbidden {
+		t.Errorf("model outside the allowed patterns: %v, want 403", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := store.admit(request("team-a", "meta-llama/Meta-Llama-3.1-8B")); err != nil {
+			t.Fatalf("request %d within the burst: %v", i, err)
+		}
+	}
+	err := store.admit(request("team-a", "meta-llama/Meta-Llama-3.1-8B"))
+	if err == nil || err.StatusCode != http.StatusTooManyRequests || err.RetryAfter <= 0 {
+		t.Errorf("request over the rate limit: %v, want 429 with Retry-After", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := store.admit(request("team-b", "org/other")); err != nil {
+			t.Errorf("tenant without limits: %v", err)
+		}
+	}
+	if err := store.admit(request("", "org/other")); err != nil {
+		t.Errorf("anonymous request: %v", err)
+	}
+}
@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,23 +20,31 @@ var (
 	prompt       string
 	maxNewTokens int
 	showBody     bool
+	traceFile    string
+	speedup      float64
+	failed       atomic.Int64 // requests without a response or answered with an error, ex. 429, 503 or 504
 )
 
 func init() {
 	flag.StringVar(&prompt, "prompt", "What is Deep Learning?", "Prompt to send to the model")
 	flag.IntVar(&maxNewTokens, "max_new_tokens", 1000, "Maximum number of tokens to generate")
 	flag.BoolVar(&showBody, "show-body", false, "Show the body of the response")
+	flag.StringVar(&traceFile, "trace", "", "JSONL trace to replay instead of sending identical requests")
+	flag.Float64Var(&speedup, "speedup", 1, "Divide the inter-arrival times of the trace by this factor")
 	flag.Usage = usage
 }
 
 func usage() {
 	fmt.Println("Usage: send [-prompt <string>] [-max_new_tokens <int>] [-show-body=true] <model> <number of requests>")
+	fmt.Println("       send -trace <file.jsonl> [-speedup <float>] [-prompt <string>] [-max_new_tokens <int>] [-show-body=true]")
 	fmt.Println("Arguments:")
 	fmt.Println("  model: Model to use")
 	fmt.Println("     0) Meta-Llama-3.1-8B")
 	fmt.Println("     1) Llama-3.2-1B-Instruct")
 	fmt.Println("     2) gpt2-small")
 	fmt.Println("  number_of_requests: Number of requests to send")
+	fmt.Println("  file.jsonl: One request per line with timestamp (RFC 3339 or seconds), model (MODEL_ID), and")
+	fmt.Println("     optional prompt, parameters, env and label, sent at the original inter-arrival times")
 	fmt.Println()
 	fmt.Println("Options:")
 	fmt.Println("  -h, --help              Display this help message")
@@ -43,6 +54,19 @@ func usage() {
 func main() {
 	flag.Parse()
 
+	client := &http.Client{}
+	if traceFile != "" {
+		if speedup <= 0 {
+			log.Fatal("Invalid speedup, must be positive")
+		}
+		records, err := readTrace(traceFile)
+		if err != nil {
+			log.Fatalf("Invalid trace: %v", err)
+		}
+		replay(client, records, speedup)
+		return
+	}
+
 	models := []string{
 		"meta-llama/Meta-Llama-3.1-8B",
 		"meta-llama/Llama-3.2-1B-Instruct",
@@ -63,7 +87,7 @@ func main() {
 
 	fmt.Printf("Sending %d requests to model %s\n", requests, model)
 
-	client := &http.Client{}
+	var wg sync.WaitGroup
 
 	for i := 0; i < requests; i++ {
 		fmt.Println("Sending request", i)
@@ -79,24 +103,56 @@ func main() {
 			"label": {}}
 		`)
 
-		req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-		if err != nil {
-			log.Fatal("Error creating request")
-			return
-		}
+		send(client, &wg, i, jsonData)
+		time.Sleep(30 * time.Millisecond)
+	}
+	wg.Wait()
+	reportFailed(requests)
+}
 
-		req.Host = "dispatcher.default.127.0.0.1.nip.io"
-		req.Header.Set("Content-Type", "application/json")
-		if showBody {
-			log.Println(req.Body)
-		}
+// send posts a request to the Dispatcher and prints its response in the background
+func send(client *http.Client, wg *sync.WaitGroup, i int, jsonData []byte) {
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		log.Fatal("Error creating request")
+		return
+	}
+
+	req.Host = "dispatcher.default.127.0.0.1.nip.io"
+	req.Header.Set("Content-Type", "application/json")
+	if showBody {
+		log.Println(req.Body)
+	}
+	// The dispatcher holds the connection until the model answers, so wait for responses concurrently
+	wg.Add(1)
+	go func(i int) {
+		defer wg.Done()
 		resp, err := client.Do(req)
 		if err != nil {
-			log.Printf("Error sending request: %v", err)
-			log.Fatal("Error sending request")
+			log.Printf("Error sending request %d: %v", i, err)
+			failed.Add(1)
 			return
 		}
 		defer resp.Body.Close()
-		time.Sleep(30 * time.Millisecond)
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			log.Printf("Error reading response %d: %v", i, err)
+			failed.Add(1)
+			return
+		}
+		fmt.Printf("Response %d (%s)\n", i, resp.Status)
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			failed.Add(1)
+		}
+		if showBody {
+			fmt.Println(string(body))
+		}
+	}(i)
+}
+
+// reportFailed prints how many of the requests got no response or an error status
+func reportFailed(requests int) {
+	if n := failed.Load(); n > 0 {
+		fmt.Printf("%d of %d requests failed\n", n, requests)
 	}
 }
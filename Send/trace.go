@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceRecord is one request of a JSONL trace, ex.
+// {"timestamp": "2025-06-19T10:00:00.250Z", "model": "meta-llama/Meta-Llama-3.1-8B", "prompt": "What is Deep Learning?", "parameters": {"max_new_tokens": 200}}
+type TraceRecord struct {
+	Timestamp  json.RawMessage        `json:"timestamp"`  // RFC 3339 time or seconds (ex. a unix time or an offset from the start of the trace)
+	Model      string                 `json:"model"`      // MODEL_ID
+	Prompt     string                 `json:"prompt"`     // -prompt if unset
+	Parameters map[string]interface{} `json:"parameters"` // sent as "par", max_new_tokens is -max_new_tokens if unset
+	Env        map[string]string      `json:"env"`        // extra env, ex. a variant's settings
+	Label      map[string]string      `json:"label"`      // ex. slo or priority
+
+	at   time.Duration // arrival relative to the first record
+	line int
+}
+
+// readTrace parses a JSONL trace, sorted by arrival. Blank lines are skipped.
+func readTrace(path string) ([]TraceRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []TraceRecord
+	var times []time.Time
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024) // prompts can be long
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var record TraceRecord
+		if err := json.Unmarshal([]byte(text), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if record.Model == "" {
+			return nil, fmt.Errorf("line %d: no model", line)
+		}
+		at, err := parseTimestamp(record.Timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		record.line = line
+		records = append(records, record)
+		times = append(times, at)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no records in %s", path)
+	}
+
+	start := times[0]
+	for _, at := range times {
+		if at.Before(start) {
+			start = at
+		}
+	}
+	for i := range records {
+		records[i].at = times[i].Sub(start)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].at < records[j].at })
+	return records, nil
+}
+
+// parseTimestamp reads an RFC 3339 time or a number of seconds, as a time on the same scale for every record
+func parseTimestamp(raw json.RawMessage) (time.Time, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return time.Time{}, fmt.Errorf("no timestamp")
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err != nil {
+		text = string(raw) // a number
+	}
+	if seconds, err := strconv.ParseFloat(text, 64); err == nil {
+		return time.Unix(0, 0).Add(time.Duration(seconds * float64(time.Second))), nil
+	}
+	at, err := time.Parse(time.RFC3339Nano, text)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %s", raw)
+	}
+	return at, nil
+}
+
+// body builds the Dispatcher request of a record
+func (r TraceRecord) body() ([]byte, error) {
+	token := r.Prompt
+	if token == "" {
+		token = prompt
+	}
+	par := map[string]interface{}{"max_new_tokens": maxNewTokens}
+	for key, value := range r.Parameters {
+		par[key] = value
+	}
+	env := map[string]string{"HF_TOKEN": os.Getenv("HF_TOKEN")}
+	for key, value := range r.Env {
+		env[key] = value
+	}
+	env["MODEL_ID"] = r.Model
+	label := r.Label
+	if label == nil {
+		label = map[string]string{}
+	}
+	return json.Marshal(map[string]interface{}{"token": token, "par": par, "env": env, "label": label})
+}
+
+// replay sends the records of a trace at their original inter-arrival times divided by speedup
+func replay(client *http.Client, records []TraceRecord, speedup float64) {
+	span := records[len(records)-1].at
+	fmt.Printf("Replaying %d requests spanning %s at %gx speed (%s)\n", len(records), span, speedup, time.Duration(float64(span)/speedup))
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i, record := range records {
+		// sleep until the arrival of the record rather than by the gap to the previous one, so delays do not add up
+		if wait := time.Until(start.Add(time.Duration(float64(record.at) / speedup))); wait > 0 {
+			time.Sleep(wait)
+		}
+		body, err := record.body()
+		if err != nil {
+			fmt.Printf("Skipping line %d: %v\n", record.line, err)
+			continue
+		}
+		fmt.Printf("Sending request %d (line %d, %s, model %s)\n", i, record.line, time.Since(start).Round(time.Millisecond), record.Model)
+		send(client, &wg, i, body)
+	}
+	wg.Wait()
+	fmt.Printf("Replayed %d requests in %s\n", len(records), time.Since(start).Round(time.Millisecond))
+	reportFailed(len(records))
+}
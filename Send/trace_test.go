@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    time.Time
+		wantErr bool
+	}{
+		{raw: `"2025-06-19T10:00:00.250Z"`, want: time.Date(2025, 6, 19, 10, 0, 0, 250e6, time.UTC)},
+		{raw: `"2025-06-19T12:00:00+02:00"`, want: time.Date(2025, 6, 19, 10, 0, 0, 0, time.UTC)},
+		{raw: `1.5`, want: time.Unix(1, 5e8)},
+		{raw: `"1.5"`, want: time.Unix(1, 5e8)},
+		{raw: `1750327200`, want: time.Unix(1750327200, 0)},
+		{raw: ``, wantErr: true},
+		{raw: `null`, wantErr: true},
+		{raw: `"yesterday"`, wantErr: true},
+		{raw: `true`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := parseTimestamp(json.RawMessage(tt.raw))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTimestamp(%s) error = %v, want error %v", tt.raw, err, tt.wantErr)
+			}
+			if !tt.wantErr && !got.Equal(tt.want) {
+				t.Errorf("parseTimestamp(%s) = %s, want %s", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadTrace(t *testing.T) {
+	tests := []struct {
+		name      string
+		trace     string
+		wantLines []int
+		wantAt    []time.Duration
+		wantErr   bool
+	}{
+		{
+			name: "sorted by arrival, relative to the earliest",
+			trace: `{"timestamp": "2025-06-19T10:00:01Z", "model": "b"}
+
+{"timestamp": "2025-06-19T10:00:00.5Z", "model": "a"}
+{"timestamp": "2025-06-19T10:00:03Z", "model": "c"}
+`,
+			wantLines: []int{3, 1, 4},
+			wantAt:    []time.Duration{0, 500 * time.Millisecond, 2500 * time.Millisecond},
+		},
+		{
+			name:      "offsets in seconds",
+			trace:     "{\"timestamp\": 10, \"model\": \"a\"}\n{\"timestamp\": 10.25, \"model\": \"a\"}\n",
+			wantLines: []int{1, 2},
+			wantAt:    []time.Duration{0, 250 * time.Millisecond},
+		},
+		{name: "no model", trace: `{"timestamp": 0, "prompt": "hi"}`, wantErr: true},
+		{name: "no timestamp", trace: `{"model": "a"}`, wantErr: true},
+		{name: "invalid json", trace: `{"timestamp": 0, "model": "a"`, wantErr: true},
+		{name: "empty", trace: "\n\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "trace.jsonl")
+			if err := os.WriteFile(path, []byte(tt.trace), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			records, err := readTrace(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readTrace() error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(records) != len(tt.wantLines) {
+				t.Fatalf("readTrace() = %d records, want %d", len(records), len(tt.wantLines))
+			}
+			for i, record := range records {
+				if record.line != tt.wantLines[i] || record.at != tt.wantAt[i] {
+					t.Errorf("record %d = line %d at %s, want line %d at %s", i, record.line, record.at, tt.wantLines[i], tt.wantAt[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTraceRecordBody(t *testing.T) {
+	record := TraceRecord{
+		Model:      "meta-llama/Meta-Llama-3.1-8B",
+		Prompt:     `say "hi"`,
+		Parameters: map[string]interface{}{"temperature": 0.5},
+		Env:        map[string]string{"MODEL_ID": "ignored"},
+		Label:      map[string]string{"slo": "0.05"},
+	}
+	body, err := record.body()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Token string                 `json:"token"`
+		Par   map[string]interface{} `json:"par"`
+		Env   map[string]string      `json:"env"`
+		Label map[string]string      `json:"label"`
+	}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("body is not JSON: %v", err)
+	}
+	if got.Token != record.Prompt || got.Env["MODEL_ID"] != record.Model || got.Label["slo"] != "0.05" ||
+		got.Par["temperature"] != 0.5 || got.Par["max_new_tokens"] != float64(maxNewTokens) {
+		t.Errorf("body() = %s", body)
+	}
+}
@@ -176,9 +176,9 @@ func (r *GPUReporter) updateNodeResourceLabel(ctx context.Context) {
 		return
 	}
 
-	// delete the original lable
+	// delete the labels of the previous report, so slices taken since are no longer listed as free
 	for key := range node.Labels {
-		if strings.HasPrefix(key, "kubecomp/status-gpu") {
+		if strings.HasPrefix(key, "kubecomp.com/status-gpu-") {
 			delete(node.Labels, key)
 		}
 	}